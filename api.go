@@ -0,0 +1,207 @@
+package impact
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// exportedAPI maps each exported symbol declared under a package directory
+// onto a rendering of its declaration. Symbols in sub-packages are
+// qualified with the sub-package's path relative to dir.
+type exportedAPI map[string]string
+
+func scanAPI(dir string) (exportedAPI, error) {
+	api := make(exportedAPI)
+	fset := token.NewFileSet()
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			name := info.Name()
+			if file != dir && (name == "vendor" || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(file, ".go") || strings.HasSuffix(file, "_test.go") {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			// a file that doesn't parse contributes no API; the build will
+			// report the real problem
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, filepath.Dir(file))
+		prefix := ""
+		if rel != "." {
+			prefix = filepath.ToSlash(rel) + "."
+		}
+
+		for _, decl := range f.Decls {
+			addDecl(api, fset, prefix, decl)
+		}
+		return nil
+	})
+
+	return api, err
+}
+
+func render(fset *token.FileSet, node interface{}) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, fset, node)
+	return buf.String()
+}
+
+func addDecl(api exportedAPI, fset *token.FileSet, prefix string, decl ast.Decl) {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if !d.Name.IsExported() {
+			return
+		}
+
+		name := d.Name.Name
+		if d.Recv != nil && len(d.Recv.List) > 0 {
+			recv := receiverType(d.Recv.List[0].Type)
+			if !ast.IsExported(recv) {
+				return
+			}
+			name = recv + "." + name
+		}
+		api[prefix+name] = render(fset, &ast.FuncDecl{Recv: d.Recv, Name: d.Name, Type: d.Type})
+
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				if s.Name.IsExported() {
+					api[prefix+s.Name.Name] = "type " + s.Name.Name + " " + render(fset, s.Type)
+				}
+
+			case *ast.ValueSpec:
+				for _, n := range s.Names {
+					if !n.IsExported() {
+						continue
+					}
+					sig := d.Tok.String() + " " + n.Name
+					if s.Type != nil {
+						sig += " " + render(fset, s.Type)
+					}
+					api[prefix+n.Name] = sig
+				}
+			}
+		}
+	}
+}
+
+func receiverType(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverType(t.X)
+
+	case *ast.IndexExpr:
+		return receiverType(t.X)
+
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// apiChange describes how a patch changed the exported API of a target.
+type apiChange struct {
+	packageName string
+	added       []string
+	removed     []string
+	changed     []string
+}
+
+func (c apiChange) empty() bool {
+	return len(c.added) == 0 && len(c.removed) == 0 && len(c.changed) == 0
+}
+
+func diffAPI(packageName string, before, after exportedAPI) apiChange {
+	c := apiChange{packageName: packageName}
+	for name, sig := range before {
+		if newSig, ok := after[name]; !ok {
+			c.removed = append(c.removed, name)
+		} else if newSig != sig {
+			c.changed = append(c.changed, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			c.added = append(c.added, name)
+		}
+	}
+
+	sort.Strings(c.added)
+	sort.Strings(c.removed)
+	sort.Strings(c.changed)
+	return c
+}
+
+// mergeAPIChanges combines the API changes seen across all of the
+// downstream packages into one summary per target. Downstream packages may
+// have fetched different versions of a target, so the patch needn't have
+// had the same effect everywhere.
+func mergeAPIChanges(results []reply) []apiChange {
+	type sets struct{ added, removed, changed map[string]bool }
+
+	order := make([]string, 0)
+	merged := make(map[string]*sets)
+	for _, r := range results {
+		for _, c := range r.apiChanges {
+			m, ok := merged[c.packageName]
+			if !ok {
+				m = &sets{make(map[string]bool), make(map[string]bool), make(map[string]bool)}
+				merged[c.packageName] = m
+				order = append(order, c.packageName)
+			}
+			for _, n := range c.added {
+				m.added[n] = true
+			}
+			for _, n := range c.removed {
+				m.removed[n] = true
+			}
+			for _, n := range c.changed {
+				m.changed[n] = true
+			}
+		}
+	}
+
+	keys := func(set map[string]bool) []string {
+		result := make([]string, 0, len(set))
+		for k := range set {
+			result = append(result, k)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	changes := make([]apiChange, 0, len(order))
+	for _, name := range order {
+		m := merged[name]
+		changes = append(changes, apiChange{
+			packageName: name,
+			added:       keys(m.added),
+			removed:     keys(m.removed),
+			changed:     keys(m.changed),
+		})
+	}
+	return changes
+}
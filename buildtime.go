@@ -0,0 +1,71 @@
+package impact
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// timeBuild measures how long a full rebuild of the package takes. The -a
+// flag stops the build cache from flattering whichever build runs second.
+func timeBuild(p pkg, logfile string, env []string) (time.Duration, error) {
+	file, err := os.Create(logfile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	build := goCommand(env, "build", "-a", p.slug)
+	if moduleMode(env) {
+		build.Dir = srcDir(env, p.slug)
+	}
+	build.Stdout = file
+	build.Stderr = file
+
+	start := time.Now()
+	err = build.Run()
+	return time.Since(start), err
+}
+
+// measureBuild times a build for the report, logging (but otherwise
+// ignoring) build failures, which the tests will pick up anyway.
+func measureBuild(s *session, idx int, p pkg, phase, logDir string, env []string) time.Duration {
+	elapsed, err := timeBuild(p, path.Join(logDir, phase+"-build.log"), env)
+	if err != nil {
+		fmt.Fprintf(s.progress, "%04d: %d Failed %s build, not timing it: %s\n", p.index, idx, phase, err.Error())
+		return 0
+	}
+	fmt.Fprintf(s.progress, "%04d: %d %s build took %s\n", p.index, idx, phase, elapsed)
+	return elapsed
+}
+
+// buildSlowdown is the fractional increase in build time from before the
+// patch to after it, or zero if either build wasn't timed.
+func buildSlowdown(r reply) float64 {
+	if r.preBuildTime == 0 || r.postBuildTime == 0 {
+		return 0
+	}
+	return float64(r.postBuildTime-r.preBuildTime) / float64(r.preBuildTime)
+}
+
+// slowestBuilds picks out the n replies whose build times regressed the
+// most.
+func slowestBuilds(results []reply, n int) []reply {
+	sorted := make([]reply, 0)
+	for _, r := range results {
+		if r.result == buildTimeRegressed {
+			sorted = append(sorted, r)
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return buildSlowdown(sorted[i]) > buildSlowdown(sorted[j])
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
@@ -0,0 +1,279 @@
+package impact
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteSize is a command line flag value holding a size in bytes, which may
+// be given with a K, M, G or T suffix.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		if i := strings.IndexByte("KMGT", value[n-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i+1))
+			value = value[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid size %q", value)
+	}
+	*b = byteSize(n * float64(multiplier))
+	return nil
+}
+
+// checkoutCache keeps copies of fetched GOPATH source trees so that later
+// runs needn't fetch them again. When given a maximum size it evicts the
+// least recently used checkouts to stay within it. Checkouts are kept
+// apart by --mode, as a module's source tree isn't laid out as GOPATH's is.
+//
+// The mutex only guards the bookkeeping, so that workers can copy
+// checkouts in and out at the same time. Entries being restored from are
+// never replaced or evicted from under their readers.
+type checkoutCache struct {
+	dir     string
+	mode    string
+	maxSize int64
+	mutex   sync.Mutex
+
+	// how many restores are reading from each entry
+	readers map[string]int
+}
+
+func newCheckoutCache(dir, mode string, maxSize int64) (*checkoutCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &checkoutCache{dir: dir, mode: mode, maxSize: maxSize, readers: make(map[string]int)}, nil
+}
+
+func (c *checkoutCache) entryDir(slug string) string {
+	return path.Join(c.dir, url.PathEscape(c.mode+"/"+slug))
+}
+
+// restore copies a cached checkout of slug into the GOPATH at workdir,
+// returning false if there is no such checkout.
+func (c *checkoutCache) restore(slug, workdir string) (bool, error) {
+	entry := c.entryDir(slug)
+
+	c.mutex.Lock()
+	if _, err := os.Stat(entry); err != nil {
+		c.mutex.Unlock()
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// an entry's modification time records when it was last used
+	now := time.Now()
+	if err := os.Chtimes(entry, now, now); err != nil {
+		c.mutex.Unlock()
+		return false, err
+	}
+	c.readers[entry]++
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.readers[entry]--
+		c.mutex.Unlock()
+	}()
+	return true, copyTree(path.Join(entry, "src"), path.Join(workdir, "src"))
+}
+
+// store adds the source tree from the GOPATH at workdir to the cache,
+// evicting older checkouts if need be to make room for it.
+func (c *checkoutCache) store(slug, workdir string) error {
+	src := path.Join(workdir, "src")
+	size, err := diskUsage(src)
+	if err != nil {
+		return err
+	}
+	if c.maxSize > 0 && size > c.maxSize {
+		return nil
+	}
+
+	tmp, err := ioutil.TempDir(c.dir, ".incoming-")
+	if err != nil {
+		return err
+	}
+	defer removeTree(tmp)
+	if err := copyTree(src, path.Join(tmp, "src")); err != nil {
+		return err
+	}
+
+	// whatever's replaced or evicted is moved out of the way while the
+	// lock is held, and removed once it's been released
+	var discarded []string
+	defer func() {
+		for _, dir := range discarded {
+			removeTree(dir)
+		}
+	}()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entryDir(slug)
+	if c.readers[entry] > 0 {
+		// another worker is restoring the same checkout, so it's cached
+		// already
+		return nil
+	}
+
+	if c.maxSize > 0 {
+		discarded, err = c.evict(c.maxSize - size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(entry); err == nil {
+		old, err := c.discard(entry)
+		if err != nil {
+			return err
+		}
+		discarded = append(discarded, old)
+	}
+	return os.Rename(tmp, entry)
+}
+
+// discard moves an entry out of the cache, returning where to, so that it
+// can be removed without holding the mutex. Must be called with the mutex
+// held.
+func (c *checkoutCache) discard(entry string) (string, error) {
+	trash, err := ioutil.TempDir(c.dir, ".discarded-")
+	if err != nil {
+		return "", err
+	}
+	return trash, os.Rename(entry, path.Join(trash, "entry"))
+}
+
+// evict discards the least recently used checkouts, other than those being
+// restored from, until the cache holds no more than budget bytes. It
+// returns the discarded checkouts for the caller to remove. Must be called
+// with the mutex held.
+func (c *checkoutCache) evict(budget int64) ([]string, error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		name string
+		used time.Time
+		size int64
+	}
+
+	entries := make([]entry, 0, len(infos))
+	var total int64
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		size, err := diskUsage(path.Join(c.dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{info.Name(), info.ModTime(), size})
+		total += size
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+
+	discarded := make([]string, 0)
+	for _, e := range entries {
+		if total <= budget {
+			break
+		}
+		dir := path.Join(c.dir, e.name)
+		if c.readers[dir] > 0 {
+			continue
+		}
+		trash, err := c.discard(dir)
+		if err != nil {
+			return discarded, err
+		}
+		discarded = append(discarded, trash)
+		total -= e.size
+	}
+
+	return discarded, nil
+}
+
+// copyTree recursively copies src to dst, preserving file modes and
+// recreating (rather than following) symlinks.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case info.Mode().IsRegular():
+			return copyFile(file, target, info.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
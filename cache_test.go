@@ -0,0 +1,43 @@
+package impact
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckoutCacheModes(t *testing.T) {
+	dir := t.TempDir()
+	workdir := t.TempDir()
+	if err := os.MkdirAll(path.Join(workdir, "src", "example.com", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, path.Join(workdir, "src", "example.com", "a"), map[string]string{"a.go": "package a\n"})
+
+	gopath, err := newCheckoutCache(dir, modeGOPATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gopath.store("example.com/a", workdir); err != nil {
+		t.Fatal(err)
+	}
+
+	// a module mode run mustn't pick up the GOPATH checkout
+	module, err := newCheckoutCache(dir, modeModule, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := module.restore("example.com/a", t.TempDir()); err != nil || cached {
+		t.Errorf("module mode restored a GOPATH checkout: %v, %v", cached, err)
+	}
+
+	restored := t.TempDir()
+	if cached, err := gopath.restore("example.com/a", restored); err != nil || !cached {
+		t.Fatalf("GOPATH checkout not restored: %v, %v", cached, err)
+	}
+	source, err := ioutil.ReadFile(path.Join(restored, "src", "example.com", "a", "a.go"))
+	if err != nil || string(source) != "package a\n" {
+		t.Errorf("restored %q, %v", source, err)
+	}
+}
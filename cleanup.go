@@ -0,0 +1,91 @@
+package impact
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// removeTree deletes dir and everything under it. Unlike a bare
+// os.RemoveAll it first makes everything in the tree writable, as the Go
+// module cache marks its files and directories read-only. Symlinks are
+// removed, never followed, so cleanup can't stray outside of dir or get
+// caught in a symlink loop.
+func removeTree(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		// directories need to be listable as well as writable for their
+		// contents to be removed
+		need := os.FileMode(0200)
+		if info.IsDir() {
+			need = 0700
+		}
+
+		if info.Mode().Perm()&need != need {
+			return os.Chmod(path, info.Mode().Perm()|need)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// removeWorkdir deletes a package's workdir once its result is in. Logs
+// that are kept in the workdir are spared, unless keepLogs says otherwise.
+func removeWorkdir(rpy reply, workdir string, keepLogs bool) error {
+	if !keepLogs || rpy.logDir != workdir {
+		return removeTree(workdir)
+	}
+
+	entries, err := ioutil.ReadDir(workdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && isLogFile(e.Name()) {
+			continue
+		}
+		if err := removeTree(path.Join(workdir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanCaches removes the module download caches left behind by a run:
+// the shared module cache, if there is one, and the module cache in each
+// package's GOPATH. The packages' logs and sources are left alone, as is
+// the checkout cache, which is there to outlive the run.
+func cleanCaches(args *arguments, pkgs []pkg) error {
+	if args.sharedModCache != "" {
+		if err := removeTree(args.sharedModCache); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range pkgs {
+		modCache := path.Join(args.workRoot, fmt.Sprintf("%04d", p.index), "pkg", "mod")
+		if err := removeTree(modCache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+// Command impact tests how a patch to one package affects the packages that
+// depend on it. See the README for its usage.
+package main
+
+import (
+	"os"
+
+	"github.com/tcsc/impact"
+)
+
+func main() {
+	os.Exit(impact.Main(os.Args[1:]))
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestBuild makes sure the command still builds as a single program.
+func TestBuild(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "impact")
+	build := exec.Command("go", "build", "-o", out, ".")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %s\n%s", err.Error(), output)
+	}
+}
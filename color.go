@@ -0,0 +1,64 @@
+package impact
+
+import (
+	"golang.org/x/term"
+	"os"
+)
+
+// The --color settings.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+const (
+	ansiReset  = "\033[0m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+
+	// clearLine returns the cursor to the start of the line and blanks it,
+	// so that the status line can be redrawn in place
+	clearLine = "\r\033[K"
+)
+
+// wantColor decides whether to colour the output written to f. In auto
+// mode that's only if f is a terminal, so that piped output stays plain.
+func wantColor(mode string, f *os.File) bool {
+	switch mode {
+	case colorAlways:
+		return true
+
+	case colorNever:
+		return false
+
+	default:
+		return isTerminal(f)
+	}
+}
+
+// isTerminal reports whether f is a terminal. Character devices such as
+// /dev/null aren't, for all that they look like one to os.Stat.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// colorize colours s as befits the result r: green for a pass, red for a
+// regression, and yellow for warnings and packages that were already
+// failing pre-patch. Anything else is left alone.
+func colorize(r testResult, s string) string {
+	switch {
+	case r == passed:
+		return ansiGreen + s + ansiReset
+
+	case isRegression(r):
+		return ansiRed + s + ansiReset
+
+	case isWarning(r), r == failedPrePatchTest:
+		return ansiYellow + s + ansiReset
+
+	default:
+		return s
+	}
+}
@@ -0,0 +1,20 @@
+package impact
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIsTerminalDevNull(t *testing.T) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// /dev/null is a character device, but output sent there shouldn't be
+	// coloured
+	if isTerminal(f) {
+		t.Errorf("%s is a terminal", os.DevNull)
+	}
+}
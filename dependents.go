@@ -0,0 +1,117 @@
+package impact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dependentsEntry records which packages in a package list depend on a
+// patched module, and when that was worked out.
+type dependentsEntry struct {
+	Computed   time.Time `json:"computed"`
+	Dependents []string  `json:"dependents"`
+}
+
+// dependentsCache maps a patched module and package list snapshot onto
+// the packages in the list that depend on the module, so that later runs
+// against the same list can skip the packages a patch can't affect.
+type dependentsCache map[string]dependentsEntry
+
+// loadDependentsCache reads a previously saved dependents cache. As with
+// the popularity cache, a missing file just means nothing is cached yet.
+func loadDependentsCache(filename string) (dependentsCache, error) {
+	result := make(dependentsCache)
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, &result)
+	return result, err
+}
+
+func saveDependentsCache(filename string, cache dependentsCache) error {
+	bytes, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, bytes, 0644)
+}
+
+// patchedModules names what the run patches: the replaced module, or the
+// packages the patches are applied to.
+func (args *arguments) patchedModules() []string {
+	if args.replace != nil {
+		return []string{args.replace.module}
+	}
+
+	names := make([]string, 0, len(args.targets))
+	seen := make(map[string]bool)
+	for _, t := range args.targets {
+		if !seen[t.packageName] {
+			seen[t.packageName] = true
+			names = append(names, t.packageName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dependentsKey identifies a patched module and a snapshot of the package
+// list. Any change to the list, even just reordering it, gets a new key.
+func dependentsKey(modules []string, packages []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(packages, "\n")))
+	return strings.Join(modules, ",") + "@" + hex.EncodeToString(sum[:8])
+}
+
+// lookup returns the cached dependents for key, if there are any no older
+// than ttl. A ttl of zero never expires.
+func (c dependentsCache) lookup(key string, ttl time.Duration) (map[string]bool, time.Time, bool) {
+	entry, ok := c[key]
+	if !ok || (ttl > 0 && time.Since(entry.Computed) > ttl) {
+		return nil, time.Time{}, false
+	}
+
+	dependents := make(map[string]bool)
+	for _, name := range entry.Dependents {
+		dependents[name] = true
+	}
+	return dependents, entry.Computed, true
+}
+
+// dependentPackages keeps the packages named in dependents, preserving
+// their order.
+func dependentPackages(pkgs []pkg, dependents map[string]bool) []pkg {
+	result := make([]pkg, 0, len(dependents))
+	for _, p := range pkgs {
+		if dependents[p.name()] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// dependentsOf picks out the packages that depend on the patched module
+// from a complete set of results. A package is only ruled out if its
+// dependencies were actually checked, so packages that failed before they
+// got that far will be tested again next time.
+func dependentsOf(results []reply) []string {
+	names := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.result == notInGraph || r.result == notExternal || (r.checkedDeps && !r.inGraph) {
+			continue
+		}
+		names = append(names, r.name())
+	}
+	sort.Strings(names)
+	return names
+}
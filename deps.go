@@ -0,0 +1,50 @@
+package impact
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// listDeps lists every package a package's tests build, itself included.
+func listDeps(p pkg, dir string, env []string) (map[string]bool, error) {
+	list := goCommand(env, "list", "-deps", "-test", p.testPattern())
+	list.Dir = path.Join(dir, "src", p.slug)
+	out, err := list.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	deps := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			deps[line] = true
+		}
+	}
+	return deps, nil
+}
+
+// dependsOn reports whether any of the patched packages are among deps, or
+// are the parent of one of them.
+func dependsOn(deps map[string]bool, targets []target) bool {
+	for dep := range deps {
+		for _, t := range targets {
+			if dep == t.packageName || strings.HasPrefix(dep, t.packageName+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addedDeps lists the packages in post that aren't in pre.
+func addedDeps(pre, post map[string]bool) []string {
+	added := make([]string, 0)
+	for dep := range post {
+		if !pre[dep] {
+			added = append(added, dep)
+		}
+	}
+	sort.Strings(added)
+	return added
+}
@@ -0,0 +1,84 @@
+package impact
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// diagnostic is a single compiler error or warning.
+type diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// compiler diagnostics are reported unindented, which tells them apart from
+// the file:line prefixes on test log messages
+var diagnosticLine = regexp.MustCompile(`^(\S+\.go):(\d+):(\d+): (.+)$`)
+
+func parseDiagnostics(filename string) ([]diagnostic, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	diags := make([]diagnostic, 0)
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		m := diagnosticLine.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		diags = append(diags, diagnostic{File: m[1], Line: line, Column: col, Message: m[4]})
+	}
+	return diags, s.Err()
+}
+
+// diagnosticGroup collects the packages that reported the same diagnostic
+// message, wherever in their code it was reported.
+type diagnosticGroup struct {
+	Message  string   `json:"message"`
+	Count    int      `json:"count"`
+	Packages []string `json:"packages"`
+}
+
+// groupDiagnostics aggregates identical diagnostics across packages, most
+// widespread first. A message like "undefined: OldFunc" turning up in many
+// packages points straight at the API the patch broke.
+func groupDiagnostics(results []reply) []diagnosticGroup {
+	groups := make(map[string]*diagnosticGroup)
+	for _, r := range results {
+		seen := make(map[string]bool)
+		for _, d := range r.diagnostics {
+			g, ok := groups[d.Message]
+			if !ok {
+				g = &diagnosticGroup{Message: d.Message, Packages: make([]string, 0)}
+				groups[d.Message] = g
+			}
+			g.Count++
+			if !seen[d.Message] {
+				seen[d.Message] = true
+				g.Packages = append(g.Packages, r.name())
+			}
+		}
+	}
+
+	result := make([]diagnosticGroup, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if len(result[i].Packages) != len(result[j].Packages) {
+			return len(result[i].Packages) > len(result[j].Packages)
+		}
+		return result[i].Message < result[j].Message
+	})
+	return result
+}
@@ -0,0 +1,55 @@
+package impact
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// dryRun checks that the patches can be read, and lists the packages that
+// would be tested along with their workdirs, without fetching, patching or
+// testing anything. It returns the process exit code.
+func dryRun(args *arguments, pkgs []pkg) int {
+	patches := make([]string, 0, len(args.targets)+len(args.patchMap))
+	for _, t := range args.targets {
+		patches = append(patches, t.patchFile)
+	}
+	for _, patchFile := range args.patchMap {
+		patches = append(patches, patchFile)
+	}
+	sort.Strings(patches)
+
+	out := args.console()
+
+	failed := 0
+	for _, patchFile := range patches {
+		if _, err := ioutil.ReadFile(patchFile); err != nil {
+			failed++
+			fmt.Fprintf(out, "Can't read patch: %s\n", err.Error())
+			continue
+		}
+		fmt.Fprintf(out, "Patch %s\n", patchFile)
+	}
+	if args.replace != nil {
+		fmt.Fprintf(out, "Replacing %s\n", args.replace)
+	}
+
+	// the workdirs are listed in full, so they can be pasted from
+	// wherever the output ends up
+	workRoot, err := filepath.Abs(args.workRoot)
+	if err != nil {
+		fmt.Fprintf(out, "Can't find the work root: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(out, "Would test %d packages:\n", len(pkgs))
+	for _, p := range pkgs {
+		fmt.Fprintf(out, "\t%s\t%s\n", filepath.Join(workRoot, fmt.Sprintf("%04d", p.index)), p.name())
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package impact
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// event records a single phase transition for a package.
+type event struct {
+	Run    string      `json:"run"`
+	Time   time.Time   `json:"time"`
+	Index  int         `json:"index"`
+	Slug   string      `json:"slug"`
+	Worker int         `json:"worker"`
+	Event  string      `json:"event"`
+	Result string      `json:"result,omitempty"`
+	Exit   *ExitStatus `json:"exit,omitempty"`
+
+	Diagnostics []diagnostic   `json:"diagnostics,omitempty"`
+	Panic       string         `json:"panic,omitempty"`
+	Tests       []testOutcome  `json:"tests,omitempty"`
+	Rejects     []rejectedHunk `json:"rejects,omitempty"`
+}
+
+// eventLog serialises events from all of the workers onto a single writer
+// as a stream of JSON objects, one per line. A nil *eventLog discards
+// everything, so callers needn't check whether logging is enabled. Events
+// emitted after the log is closed (e.g. by workers still running after an
+// interrupt) are dropped.
+type eventLog struct {
+	runTag string
+	mutex  sync.Mutex
+	closed bool
+	events chan event
+	done   chan error
+}
+
+func newEventLog(w io.Writer, runTag string) *eventLog {
+	l := &eventLog{
+		runTag: runTag,
+		events: make(chan event, 100),
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		var err error
+		enc := json.NewEncoder(w)
+		for e := range l.events {
+			if err == nil {
+				err = enc.Encode(e)
+			}
+		}
+		l.done <- err
+	}()
+
+	return l
+}
+
+func (l *eventLog) emit(p pkg, worker int, name, result string) {
+	l.emitExit(p, worker, name, result, nil)
+}
+
+// emitExit records an event marking the end of a phase that ran a child
+// process, along with how that process exited.
+func (l *eventLog) emitExit(p pkg, worker int, name, result string, exit *ExitStatus) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+
+	l.events <- event{
+		Run:    l.runTag,
+		Time:   time.Now(),
+		Index:  p.index,
+		Slug:   p.name(),
+		Worker: worker,
+		Event:  name,
+		Result: result,
+		Exit:   exit,
+	}
+}
+
+// emitDone records the end of a package's check, along with the details of
+// its result.
+func (l *eventLog) emitDone(p pkg, worker int, rpy reply) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+
+	l.events <- event{
+		Run:         l.runTag,
+		Time:        time.Now(),
+		Index:       p.index,
+		Slug:        p.name(),
+		Worker:      worker,
+		Event:       "done",
+		Result:      resultCode(rpy.result),
+		Diagnostics: rpy.diagnostics,
+		Panic:       rpy.setupPanic,
+		Tests:       rpy.tests,
+		Rejects:     rpy.rejectedHunks(),
+	}
+}
+
+// close flushes any outstanding events and reports the first error
+// encountered while writing them.
+func (l *eventLog) close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	l.closed = true
+	close(l.events)
+	l.mutex.Unlock()
+
+	return <-l.done
+}
@@ -0,0 +1,60 @@
+package impact
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const excludedSuffix = ".excluded"
+
+// excludeTestFiles hides the test files under pkgDir that match any of the
+// patterns from the go tool by renaming them, and returns the files it
+// renamed. Patterns are matched against both the file's path relative to
+// pkgDir and its base name.
+func excludeTestFiles(pkgDir string, patterns []string) ([]string, error) {
+	excluded := make([]string, 0)
+	if len(patterns) == 0 {
+		return excluded, nil
+	}
+
+	err := filepath.Walk(pkgDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(file, "_test.go") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(pkgDir, file)
+		if err != nil {
+			return err
+		}
+
+		for _, pattern := range patterns {
+			relMatch, _ := filepath.Match(pattern, filepath.ToSlash(rel))
+			baseMatch, _ := filepath.Match(pattern, info.Name())
+			if relMatch || baseMatch {
+				if err := os.Rename(file, file+excludedSuffix); err != nil {
+					return err
+				}
+				excluded = append(excluded, file)
+				break
+			}
+		}
+		return nil
+	})
+
+	return excluded, err
+}
+
+// restoreTestFiles undoes excludeTestFiles.
+func restoreTestFiles(files []string) error {
+	var firstErr error
+	for _, f := range files {
+		if err := os.Rename(f+excludedSuffix, f); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,50 @@
+package impact
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ExitStatus records how a child process finished: its exit code or, if
+// it was killed, the signal that killed it. A code of -1 with no signal
+// means the process couldn't be run at all.
+type ExitStatus struct {
+	Phase  string `json:"phase"`
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+func newExitStatus(phase string, err error) ExitStatus {
+	status := ExitStatus{Phase: phase}
+	if err == nil {
+		return status
+	}
+
+	// a timeout is recorded as the kill that ended it
+	if t, ok := err.(testTimeout); ok {
+		err = t.err
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		status.Code = -1
+		return status
+	}
+
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status.Code = -1
+		status.Signal = ws.Signal().String()
+		return status
+	}
+
+	status.Code = exitErr.ExitCode()
+	return status
+}
+
+// recordExit notes how a phase's process finished on the reply, and
+// returns the status for logging.
+func (rpy *reply) recordExit(phase string, err error) *ExitStatus {
+	status := newExitStatus(phase, err)
+	rpy.exits = append(rpy.exits, status)
+	return &status
+}
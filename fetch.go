@@ -0,0 +1,185 @@
+package impact
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Fetcher gets the source of a package, and of everything it depends on,
+// into the GOPATH at dir.
+type Fetcher interface {
+	Fetch(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error)
+}
+
+// goGetFetcher fetches packages with `go get`. It's the default.
+type goGetFetcher struct{}
+
+func (goGetFetcher) Fetch(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error) {
+	if moduleMode(env) {
+		return fetchModule(s, idx, p, dir, timeout, env)
+	}
+	return fetchCode(s, idx, p, dir, timeout, env)
+}
+
+// gitFetcher clones the package from a git repository, optionally at a
+// given ref, for packages that aren't go gettable from their import path.
+// Its dependencies are then fetched as usual.
+type gitFetcher struct {
+	url string
+	ref string
+}
+
+func (f gitFetcher) Fetch(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error) {
+	pkgDir := path.Join(dir, "src", p.slug)
+	fmt.Fprintf(s.progress, "%04d: %d Cloning %s\n", p.index, idx, f.url)
+	clone := exec.Command("git", "clone", "-q", f.url, pkgDir)
+	clone.Env = env
+	if result, err := runFetchCommand(s, idx, p, clone, timeout); result != passed {
+		return result, err
+	}
+
+	if f.ref != "" {
+		checkout := exec.Command("git", "checkout", "-q", f.ref)
+		checkout.Dir = pkgDir
+		checkout.Env = env
+		checkout.Stdout = s.progress
+		checkout.Stderr = s.progress
+		if err := checkout.Run(); err != nil {
+			return fetchFailed, err
+		}
+	}
+
+	return fetchDeps(s, idx, p, dir, timeout, env)
+}
+
+// copyFetcher copies the package from a local directory, and then fetches
+// its dependencies as usual.
+type copyFetcher struct {
+	source string
+}
+
+func (f copyFetcher) Fetch(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error) {
+	pkgDir := path.Join(dir, "src", p.slug)
+	fmt.Fprintf(s.progress, "%04d: %d Copying %s\n", p.index, idx, f.source)
+	if err := os.MkdirAll(path.Dir(pkgDir), 0755); err != nil {
+		return failedUnexpectedly, err
+	}
+	if err := copyTree(f.source, pkgDir); err != nil {
+		return fetchFailed, err
+	}
+	return fetchDeps(s, idx, p, dir, timeout, env)
+}
+
+// parseFetcher interprets a FETCH annotation's value: git=url[@ref] or
+// copy=path.
+func parseFetcher(spec string) (Fetcher, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("invalid fetcher %q", spec)
+	}
+
+	switch kind {
+	case "git":
+		f := gitFetcher{url: arg}
+		// a ref follows the last @, unless that's part of a scp-style
+		// git@host:repo URL
+		if i := strings.LastIndex(arg, "@"); i > 0 && !strings.Contains(arg[i:], ":") {
+			f.url, f.ref = arg[:i], arg[i+1:]
+		}
+		return f, nil
+
+	case "copy":
+		return copyFetcher{source: arg}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown fetcher %q", kind)
+	}
+}
+
+// fetcher is how to fetch the package.
+func (p pkg) fetcher() Fetcher {
+	if p.fetch == nil {
+		return goGetFetcher{}
+	}
+	return p.fetch
+}
+
+// resolvedVersion works out exactly which version of the package was
+// fetched: the module version go get resolved in module mode, or the
+// commit checked out otherwise. It's empty if that can't be worked out.
+func resolvedVersion(p pkg, dir string, env []string) string {
+	if moduleMode(env) && p.fetch == nil {
+		edit := goCommand(env, "mod", "edit", "-json")
+		edit.Dir = path.Join(dir, "fetch")
+		out, err := edit.Output()
+		if err != nil {
+			return ""
+		}
+
+		var mod struct {
+			Require []struct {
+				Path    string
+				Version string
+			}
+		}
+		if err := json.Unmarshal(out, &mod); err != nil {
+			return ""
+		}
+
+		// the scratch module imports nothing, so everything it requires
+		// is indirect; the package's module is the longest path that
+		// contains it
+		longest, version := "", ""
+		for _, r := range mod.Require {
+			if (p.slug == r.Path || strings.HasPrefix(p.slug, r.Path+"/")) && len(r.Path) > len(longest) {
+				longest, version = r.Path, r.Version
+			}
+		}
+		return version
+	}
+
+	// stop git from finding some repository the workdir happens to be in
+	rev := exec.Command("git", "rev-parse", "HEAD")
+	rev.Dir = path.Join(dir, "src", p.slug)
+	rev.Env = setEnv(env, "GIT_CEILING_DIRECTORIES", dir)
+	out, err := rev.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// runFetchCommand runs a command that's part of a fetch, killing it and
+// anything it has started if it takes longer than timeout.
+func runFetchCommand(s *session, idx int, p pkg, cmd *exec.Cmd, timeout time.Duration) (testResult, error) {
+	cmd.Stdout = s.progress
+	cmd.Stderr = s.progress
+	if err := s.start(cmd); err != nil {
+		return fetchFailed, err
+	}
+	defer s.finished(cmd)
+
+	ch := make(chan error, 1)
+	go func() { ch <- cmd.Wait() }()
+	select {
+	case err := <-ch:
+		if err != nil {
+			return fetchFailed, err
+		}
+		return passed, nil
+
+	case <-time.After(timeout):
+		fmt.Fprintf(s.progress, "%04d: %d Timed out\n", p.index, idx)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return fetchTimedOut, <-ch
+	}
+}
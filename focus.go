@@ -0,0 +1,50 @@
+package impact
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// loadFocusTests reads a file naming the tests to focus on in particular
+// packages, one "slug regexp" pair per line, the regexp being as for
+// `go test -run`.
+func loadFocusTests(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	focus := make(map[string]string)
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"slug regexp\"", filename, n)
+		}
+		if _, err := regexp.Compile(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, n, err.Error())
+		}
+		focus[fields[0]] = fields[1]
+	}
+	return focus, s.Err()
+}
+
+// focusedPackages drops the packages without focus tests.
+func focusedPackages(pkgs []pkg, focus map[string]string) []pkg {
+	result := make([]pkg, 0, len(pkgs))
+	for _, p := range pkgs {
+		if _, ok := focus[p.slug]; ok {
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,22 @@
+package impact
+
+import (
+	"os"
+	"path"
+)
+
+// runGenerate runs `go generate` over the package, logging its output, so
+// that the effect of a patch to a code generator shows up in the tests.
+func runGenerate(p pkg, logfile, dir string, env []string) error {
+	file, err := os.Create(logfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	generate := goCommand(env, "generate", p.testPattern())
+	generate.Dir = path.Join(dir, "src", p.slug)
+	generate.Stdout = file
+	generate.Stderr = file
+	return generate.Run()
+}
@@ -0,0 +1,205 @@
+package impact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// The Checks API accepts at most this many annotations per request.
+const maxAnnotationsPerRequest = 50
+
+type checkAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+}
+
+type checkOutput struct {
+	Title       string            `json:"title"`
+	Summary     string            `json:"summary"`
+	Annotations []checkAnnotation `json:"annotations"`
+}
+
+// checkConclusion maps the run's outcome onto a check run conclusion.
+func checkConclusion(summary map[testResult]int) string {
+	for r, count := range summary {
+		if count > 0 && isRegression(r) {
+			return "failure"
+		}
+	}
+	return "success"
+}
+
+// buildCheckOutput turns the run's results into the output of a GitHub check
+// run, with an annotation for every post-patch test failure that reported
+// where it failed. Paths are given relative to the GOPATH, i.e. prefixed
+// with the downstream package's slug.
+func buildCheckOutput(runTag string, results []reply, summary map[testResult]int) checkOutput {
+	out := checkOutput{
+		Title:       fmt.Sprintf("impact: %d packages tested", len(results)),
+		Annotations: make([]checkAnnotation, 0),
+	}
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "Run `%s`\n\n", runTag)
+	classes := make([]testResult, 0, len(summary))
+	for r := range summary {
+		classes = append(classes, r)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i] < classes[j] })
+	for _, r := range classes {
+		fmt.Fprintf(&text, "- %s: %d\n", r.Error(), summary[r])
+	}
+
+	for _, r := range results {
+		if !isRegression(r.result) {
+			continue
+		}
+
+		fmt.Fprintf(&text, "\n**%s**: %s\n", r.name(), r.result.Error())
+		if r.setupPanic != "" {
+			fmt.Fprintf(&text, "```\n%s\n```\n", r.setupPanic)
+		}
+		for _, f := range r.failures {
+			if f.file == "" {
+				fmt.Fprintf(&text, "- `%s`\n", f.test)
+				continue
+			}
+
+			out.Annotations = append(out.Annotations, checkAnnotation{
+				Path:            path.Join(r.slug, f.file),
+				StartLine:       f.line,
+				EndLine:         f.line,
+				AnnotationLevel: "failure",
+				Title:           fmt.Sprintf("%s failed in %s", f.test, r.name()),
+				Message:         f.message,
+			})
+		}
+	}
+
+	out.Summary = text.String()
+	return out
+}
+
+type checkRun struct {
+	ID         int64        `json:"id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	HeadSHA    string       `json:"head_sha,omitempty"`
+	Status     string       `json:"status,omitempty"`
+	Conclusion string       `json:"conclusion,omitempty"`
+	Completed  *time.Time   `json:"completed_at,omitempty"`
+	Output     *checkOutput `json:"output,omitempty"`
+}
+
+func githubRequest(method, url, token string, body interface{}, reply interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("GitHub returned %s: %s", rsp.Status, bytes.TrimSpace(data))
+	}
+
+	if reply != nil {
+		return json.Unmarshal(data, reply)
+	}
+	return nil
+}
+
+// publishCheckRun creates a completed check run on the given commit. As the
+// API limits how many annotations a single request may carry, any beyond
+// the first batch are added by updating the check run afterwards.
+func publishCheckRun(repo, sha, token string, out checkOutput, conclusion string) error {
+	annotations := out.Annotations
+	batch := func() []checkAnnotation {
+		n := len(annotations)
+		if n > maxAnnotationsPerRequest {
+			n = maxAnnotationsPerRequest
+		}
+		result := annotations[:n]
+		annotations = annotations[n:]
+		return result
+	}
+
+	now := time.Now()
+	first := out
+	first.Annotations = batch()
+
+	url := fmt.Sprintf("https://api.github.com/repos/%s/check-runs", repo)
+	var created checkRun
+	err := githubRequest("POST", url, token, checkRun{
+		Name:       "impact",
+		HeadSHA:    sha,
+		Status:     "completed",
+		Conclusion: conclusion,
+		Completed:  &now,
+		Output:     &first,
+	}, &created)
+	if err != nil {
+		return err
+	}
+
+	for len(annotations) > 0 {
+		next := out
+		next.Annotations = batch()
+		err = githubRequest("PATCH", fmt.Sprintf("%s/%d", url, created.ID), token,
+			checkRun{Output: &next}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reportToGitHub writes the check run output to a file and, if a repo and
+// commit were given, publishes it as a check run using the token from
+// GITHUB_TOKEN.
+func reportToGitHub(args *arguments, results []reply, summary map[testResult]int) error {
+	out := buildCheckOutput(args.runTag, results, summary)
+
+	if args.githubChecksFile != "" {
+		if err := writeJSON(args.githubChecksFile, out); err != nil {
+			return err
+		}
+	}
+
+	if args.githubRepo == "" {
+		return nil
+	}
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return fmt.Errorf("GITHUB_TOKEN must be set to publish a check run")
+	}
+	return publishCheckRun(args.githubRepo, args.githubSHA, token, out, checkConclusion(summary))
+}
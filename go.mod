@@ -0,0 +1,10 @@
+module github.com/tcsc/impact
+
+go 1.18
+
+require (
+	github.com/ogier/pflag v0.0.1
+	golang.org/x/term v0.5.0
+)
+
+require golang.org/x/sys v0.5.0 // indirect
@@ -0,0 +1,134 @@
+package impact
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The components of the impact score.
+const (
+	impactRegressions = "regressions"
+	impactTests       = "tests"
+	impactBuilds      = "builds"
+	impactPopularity  = "popularity"
+)
+
+// impactWeights says how much each component counts towards the impact
+// score, and doubles as the value for the --impact-weights flag, which takes
+// entries of the form "component=weight".
+type impactWeights map[string]float64
+
+func defaultImpactWeights() impactWeights {
+	return impactWeights{
+		impactRegressions: 0.4,
+		impactTests:       0.2,
+		impactBuilds:      0.2,
+		impactPopularity:  0.2,
+	}
+}
+
+func (w impactWeights) String() string {
+	names := make([]string, 0, len(w))
+	for name := range w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fmt.Sprintf("%s=%g", name, w[name]))
+	}
+	return strings.Join(entries, ",")
+}
+
+func (w impactWeights) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid impact weight %q: expected component=weight", entry)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		switch name {
+		case impactRegressions, impactTests, impactBuilds, impactPopularity:
+
+		default:
+			return fmt.Errorf("Unknown impact score component %q", name)
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || weight < 0 {
+			return fmt.Errorf("Invalid weight in %q", entry)
+		}
+		w[name] = weight
+	}
+	return nil
+}
+
+// impactScore sums up how dangerous a patch looks as a number from 0 to
+// 100. Each component is the fraction of testable packages (or of what
+// they stand for) that the patch hurt:
+//
+//	regressions  regressed packages / testable packages
+//	tests        tests failing post-patch / tests run pre-patch
+//	builds       packages the patch stopped building / testable packages
+//	popularity   importers of regressed packages / importers of testable ones
+//
+// and the score is their weighted mean, scaled to 100. Components that
+// can't be worked out, like popularity when it wasn't looked up, are left
+// out of the mean rather than counted as zero.
+func impactScore(results []reply, weights impactWeights) (float64, map[string]float64) {
+	testable, regressed, builds := 0, 0, 0
+	testsRun, testsFailed := 0, 0
+	importers, regressedImporters := 0, 0
+	for _, r := range results {
+		if !isTestable(r.result) {
+			continue
+		}
+		testable++
+		importers += r.importers
+		if r.testsCounted {
+			testsRun += r.preTests
+		}
+
+		if !isRegression(r.result) {
+			continue
+		}
+		regressed++
+		regressedImporters += r.importers
+
+		testsFailed += len(r.failedTests())
+
+		if r.result == importCycle || len(r.diagnostics) > 0 {
+			builds++
+		}
+	}
+
+	components := make(map[string]float64)
+	if testable == 0 {
+		return 0, components
+	}
+	components[impactRegressions] = float64(regressed) / float64(testable)
+	components[impactBuilds] = float64(builds) / float64(testable)
+	if testsRun > 0 {
+		components[impactTests] = float64(testsFailed) / float64(testsRun)
+		if components[impactTests] > 1 {
+			components[impactTests] = 1
+		}
+	}
+	if importers > 0 {
+		components[impactPopularity] = float64(regressedImporters) / float64(importers)
+	}
+
+	total, weight := 0.0, 0.0
+	for name, value := range components {
+		total += weights[name] * value
+		weight += weights[name]
+	}
+	if weight == 0 {
+		return 0, components
+	}
+	return 100 * total / weight, components
+}
@@ -0,0 +1,103 @@
+package impact
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+)
+
+// junitSuite is the <testsuite> of a JUnit report, with a test case for
+// each package.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	Skipped   *junitProblem `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Detail  string `xml:",chardata"`
+}
+
+// isSkip reports whether a result means the patch was never tested
+// against the package, as opposed to the package breaking first.
+func isSkip(r testResult) bool {
+	switch r {
+	case patchNotApplicable, skippedTooSlow, notExternal, notInGraph, skippedOutOfTime, noTests,
+		skippedFailFast:
+		return true
+	}
+	return false
+}
+
+// writeJUnitReport writes the results as a JUnit test suite, so that CI
+// systems can show them alongside their own tests. Regressions are
+// failures, packages that couldn't be tested are errors, and packages the
+// patch doesn't apply to are skipped. Warnings pass, with the warning in
+// the test case's output.
+func writeJUnitReport(w io.Writer, runTag string, results []reply) error {
+	suite := junitSuite{Name: "impact " + runTag, Tests: len(results)}
+	var total time.Duration
+	for _, rpy := range results {
+		total += rpy.duration
+		c := junitCase{
+			Name:      rpy.name(),
+			ClassName: "impact",
+			Time:      rpy.duration.Seconds(),
+		}
+
+		problem := &junitProblem{Message: rpy.result.Error(), Type: resultCode(rpy.result)}
+		if rpy.err_ != nil {
+			problem.Detail = rpy.err_.Error()
+		}
+		if tests := rpy.failedTests(); len(tests) > 0 {
+			problem.Detail = "Failed tests:\n\t" + strings.Join(tests, "\n\t")
+		}
+		switch {
+		case isRegression(rpy.result):
+			suite.Failures++
+			c.Failure = problem
+
+		case isSkip(rpy.result):
+			suite.Skipped++
+			c.Skipped = problem
+
+		case isWarning(rpy.result):
+			c.SystemOut = rpy.result.Error()
+
+		case rpy.result != passed:
+			suite.Errors++
+			c.Error = problem
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Time = total.Seconds()
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,104 @@
+package impact
+
+import (
+	"bufio"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// leakCheckFile is the test file injected into a package to check for
+// leaks. Go runs a package's tests file by file in name order, so its test
+// runs after all of the package's own tests, unless they are shuffled.
+const leakCheckFile = "zzzz_impact_leak_test.go"
+
+// leakCheckSource reports how many more goroutines and open files there
+// are after the package's tests have run than there were before. It's
+// coarse, but needs nothing from the package's tests.
+const leakCheckSource = `package %s
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var impactGoroutines, impactFDs = runtime.NumGoroutine(), impactOpenFDs()
+
+func impactOpenFDs() int {
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	return len(fds)
+}
+
+func TestZZZZImpactLeakCheck(t *testing.T) {
+	// give goroutines that are on their way out a moment to finish
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > impactGoroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the test's own goroutine doesn't count
+	fmt.Printf("IMPACT-LEAK goroutines=%%d fds=%%d\n",
+		runtime.NumGoroutine()-impactGoroutines-1, impactOpenFDs()-impactFDs)
+}
+`
+
+// leakStats is what the leak check found in a test run.
+type leakStats struct {
+	found      bool
+	goroutines int
+	fds        int
+}
+
+// injectLeakCheck adds the leak check test to the package, returning the
+// file to remove once testing is done. A package without tests is left
+// alone, so that it's still seen to have none, and the file is empty.
+func injectLeakCheck(pkgDir string) (string, error) {
+	// go/build applies the build constraints, so that files the go tool
+	// won't build, such as "ignore"d generators, don't set the name
+	bp, err := build.ImportDir(pkgDir, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(bp.TestGoFiles) == 0 && len(bp.XTestGoFiles) == 0 {
+		return "", nil
+	}
+
+	filename := path.Join(pkgDir, leakCheckFile)
+	return filename, ioutil.WriteFile(filename, []byte(fmt.Sprintf(leakCheckSource, bp.Name+"_test")), 0644)
+}
+
+// parseLeakCheck reads the leak check's findings from a test log.
+func parseLeakCheck(filename string) (leakStats, error) {
+	var stats leakStats
+	file, err := os.Open(filename)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "IMPACT-LEAK ") {
+			continue
+		}
+		_, err := fmt.Sscanf(line, "IMPACT-LEAK goroutines=%d fds=%d", &stats.goroutines, &stats.fds)
+		stats.found = err == nil
+	}
+	return stats, s.Err()
+}
+
+// leaksMore decides whether the post-patch tests leaked more than the
+// pre-patch tests did.
+func leaksMore(pre, post leakStats) bool {
+	if !pre.found || !post.found {
+		return false
+	}
+	return post.goroutines > pre.goroutines || post.fds > pre.fds
+}
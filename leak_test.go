@@ -0,0 +1,50 @@
+package impact
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInjectLeakCheck(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"gen.go":      "//go:build ignore\n\npackage main\n",
+		"lib.go":      "package lib\n",
+		"lib_test.go": "package lib\n",
+	})
+
+	filename, err := injectLeakCheck(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(source), "package lib_test\n") {
+		t.Errorf("leak check in the wrong package:\n%s", source)
+	}
+}
+
+func TestInjectLeakCheckWithoutTests(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"lib.go": "package lib\n"})
+
+	filename, err := injectLeakCheck(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "" {
+		t.Errorf("leak check injected into a package without tests: %s", filename)
+	}
+}
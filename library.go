@@ -0,0 +1,151 @@
+package impact
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Config describes a run for callers using impact as a package rather than
+// through its command line.
+type Config struct {
+	// Args are the command line flags the run would have been given, e.g.
+	// []string{"-d", "fix.patch", "-n", "4"}.
+	Args []string
+
+	// Packages, if not nil, are the packages to test, in the same form as
+	// the lines of a package list. They take the place of the package list
+	// named in Args.
+	Packages []string
+}
+
+// Package is a package for a Runner to check.
+type Package struct {
+	Slug string
+
+	// the version (any VCS ref) to test, rather than the latest
+	Version string
+
+	// extra environment variables to test the package with, as NAME=value
+	Env []string
+}
+
+// Reply is the outcome of testing a single package.
+type Reply struct {
+	Index   int
+	Package string
+
+	// the version the package was pinned to, and the one actually fetched
+	Pinned          string
+	ResolvedVersion string
+
+	// Code is the result's short code, e.g. "P!" or "F2", and Result its
+	// description
+	Code   string
+	Result string
+	Err    error
+
+	FailedTests []string
+	Duration    time.Duration
+	LogDir      string
+}
+
+// Summary totals up a run.
+type Summary struct {
+	// how many packages got each result, keyed by result code
+	Counts map[string]int
+
+	Regressions int
+	Warnings    int
+
+	// the status the command line tool would have exited with
+	ExitCode int
+}
+
+func exportReply(rpy reply) Reply {
+	return Reply{
+		Index:           rpy.index,
+		Package:         rpy.slug,
+		Pinned:          rpy.version,
+		ResolvedVersion: rpy.resolvedVersion,
+		Code:            resultCode(rpy.result),
+		Result:          rpy.result.Error(),
+		Err:             rpy.err_,
+		FailedTests:     rpy.failedTests(),
+		Duration:        rpy.duration,
+		LogDir:          rpy.logDir,
+	}
+}
+
+// Run carries out a run as the command line tool would, calling onResult
+// (if it's not nil) with each package's outcome as it comes in. Cancelling
+// ctx stops the run, killing the fetches and tests under way. It returns an
+// error only if the run couldn't get going at all; regressions are reported
+// in the Summary.
+func Run(ctx context.Context, cfg Config, onResult func(Reply)) (Summary, error) {
+	args, err := parseArgs(cfg.Args)
+	if err != nil {
+		return Summary{ExitCode: 1}, err
+	}
+	if cfg.Packages != nil {
+		args.packageList = cfg.Packages
+	}
+
+	var callback func(reply)
+	if onResult != nil {
+		callback = func(rpy reply) { onResult(exportReply(rpy)) }
+	}
+	results, status := run(ctx, args, callback)
+
+	summary := Summary{Counts: make(map[string]int), ExitCode: status}
+	for r, n := range results {
+		summary.Counts[resultCode(r)] += n
+		if isRegression(r) {
+			summary.Regressions += n
+		}
+		if isWarning(r) {
+			summary.Warnings += n
+		}
+	}
+	if status == 1 {
+		return summary, fmt.Errorf("impact run failed")
+	}
+	return summary, nil
+}
+
+// Main runs the command line tool with the given arguments (not including
+// the program name), and returns the process exit code.
+func Main(argv []string) int {
+	if len(argv) > 0 && argv[0] == "probe" {
+		return probe(argv[1:])
+	}
+	if len(argv) > 0 && argv[0] == "render" {
+		return renderCommand(argv[1:])
+	}
+
+	args, err := parseArgs(argv)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	// ^C stops the run, rather than the process, so that the report still
+	// gets written
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	_, status := run(ctx, args, nil)
+	return status
+}
@@ -0,0 +1,82 @@
+package impact
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+func hasCRLF(filename string) (bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Contains(data, []byte("\r\n")), nil
+}
+
+// lineEndingMismatch reports whether a patch and any of the files it
+// patches disagree over CRLF line endings, which is enough to stop the
+// patch applying.
+func lineEndingMismatch(patchFile, pkgDir string, strip int) bool {
+	patchCRLF, err := hasCRLF(patchFile)
+	if err != nil {
+		return false
+	}
+
+	files, err := patchedFiles(patchFile, strip)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		crlf, err := hasCRLF(path.Join(pkgDir, f))
+		if err == nil && crlf != patchCRLF {
+			return true
+		}
+	}
+	return false
+}
+
+func toLF(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(data, []byte("\r\n")) {
+		return nil
+	}
+	return ioutil.WriteFile(filename, bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1), info.Mode())
+}
+
+// normalizeLineEndings converts a patch, and the files it patches, to LF
+// line endings, so that the patch applies wherever either came from. The
+// normalized copy of the patch is written to tmpDir, and returned.
+func normalizeLineEndings(patchFile, pkgDir, tmpDir string, strip int) (string, error) {
+	files, err := patchedFiles(patchFile, strip)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		err := toLF(path.Join(pkgDir, f))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	data, err := ioutil.ReadFile(patchFile)
+	if err != nil {
+		return "", err
+	}
+	normalized, err := ioutil.TempFile(tmpDir, "normalized-*.patch")
+	if err != nil {
+		return "", err
+	}
+	defer normalized.Close()
+
+	_, err = normalized.Write(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1))
+	return normalized.Name(), err
+}
@@ -0,0 +1,51 @@
+package impact
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// logDirName turns a package's name into the name of its directory under
+// --log-dir. Slashes become commas, which can't appear in an import path
+// or a version, so no two packages end up sharing a directory, and the
+// names still sort and read like the packages they stand for.
+func logDirName(name string) string {
+	return strings.Replace(name, "/", ",", -1)
+}
+
+// linkLogs symlinks whichever of a package's logs are still around into its
+// directory under logDir, replacing any left there by an earlier run.
+func linkLogs(rpy reply, logDir string) error {
+	if rpy.logDir == "" {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(rpy.logDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	dir := path.Join(logDir, logDirName(rpy.name()))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !isLogFile(e.Name()) {
+			continue
+		}
+		err := os.Symlink(path.Join(rpy.logDir, e.Name()), path.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
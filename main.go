@@ -1,30 +1,54 @@
-package main
+package impact
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	pflag "github.com/ogier/pflag"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 )
 
 type testResult int
 
 const (
-	fetchTimedOut       testResult = iota
-	fetchFailed         testResult = iota
-	failedPrePatchTest  testResult = iota
-	failedPostPatchTest testResult = iota
-	failedUnexpectedly  testResult = iota
-	patchFailed         testResult = iota
-	passed              testResult = iota
+	fetchTimedOut        testResult = iota
+	fetchFailed          testResult = iota
+	failedPrePatchTest   testResult = iota
+	failedPostPatchTest  testResult = iota
+	failedUnexpectedly   testResult = iota
+	patchFailed          testResult = iota
+	patchNotApplicable   testResult = iota
+	testsSilentlySkipped testResult = iota
+	importCycle          testResult = iota
+	buildTimeRegressed   testResult = iota
+	orderDependent       testResult = iota
+	testSetupFailed      testResult = iota
+	nondeterministic     testResult = iota
+	fetchUnsupported     testResult = iota
+	versionShadowed      testResult = iota
+	skippedTooSlow       testResult = iota
+	generateFailed       testResult = iota
+	notExternal          testResult = iota
+	resourceLeak         testResult = iota
+	notInGraph           testResult = iota
+	testTimedOut         testResult = iota
+	skippedOutOfTime     testResult = iota
+	noTests              testResult = iota
+	flakyTests           testResult = iota
+	skippedFailFast      testResult = iota
+	passed               testResult = iota
 )
 
 func (e testResult) Error() string {
@@ -47,6 +71,63 @@ func (e testResult) Error() string {
 	case patchFailed:
 		return "Patch failed to apply"
 
+	case patchNotApplicable:
+		return "Patch not applicable"
+
+	case testsSilentlySkipped:
+		return "Passed, but ran fewer tests post-patch"
+
+	case importCycle:
+		return "Patch introduced an import cycle"
+
+	case buildTimeRegressed:
+		return "Passed, but builds more slowly post-patch"
+
+	case orderDependent:
+		return "Failed post-patch testing only when shuffled"
+
+	case testSetupFailed:
+		return "Failed post-patch test setup"
+
+	case nondeterministic:
+		return "Post-patch test runs disagreed"
+
+	case fetchUnsupported:
+		return "Fetch unsupported outside a module"
+
+	case versionShadowed:
+		return "Patched go.mod not seen by the package's selected version"
+
+	case skippedTooSlow:
+		return "Skipped, pre-patch tests too slow"
+
+	case generateFailed:
+		return "Failed post-patch go generate"
+
+	case notExternal:
+		return "Not an external package"
+
+	case resourceLeak:
+		return "Passed, but leaks more post-patch"
+
+	case notInGraph:
+		return "Replaced module not a dependency"
+
+	case testTimedOut:
+		return "Post-patch tests timed out"
+
+	case skippedOutOfTime:
+		return "Skipped, the run ran out of time"
+
+	case noTests:
+		return "Passed, but has no tests"
+
+	case flakyTests:
+		return "Failed post-patch testing, but passed on a rerun"
+
+	case skippedFailFast:
+		return "Skipped, the run stopped at the first regression"
+
 	case passed:
 		return "Passed"
 
@@ -56,333 +137,2596 @@ func (e testResult) Error() string {
 }
 
 type pkg struct {
-	index int
-	slug  string
+	index     int
+	slug      string
+	importers int
+
+	// extra environment variables to test the package with
+	env []string
+
+	// test files to exclude when testing the package
+	excludeTests []string
+
+	// the version (any VCS ref) to test, rather than the latest
+	version string
+
+	// whether to test the package's sub-packages along with it
+	recursive bool
+
+	// how to fetch the package, if not with go get
+	fetch Fetcher
+}
+
+// isStandard reports whether the package is (or looks like) part of the
+// standard library, whose import paths have no dot in their first element.
+// There's nothing to fetch or patch for those.
+func (p pkg) isStandard() bool {
+	first := strings.SplitN(p.slug, "/", 2)[0]
+	return !strings.Contains(first, ".")
+}
+
+// name identifies the package, and the version of it under test if that's
+// not simply the latest.
+func (p pkg) name() string {
+	if p.version == "" {
+		return p.slug
+	}
+	return p.slug + "@" + p.version
+}
+
+// expandVersions turns each package into one job per version, so that the
+// patch can be tested against several versions of every package.
+func expandVersions(pkgs []pkg, versions []string) []pkg {
+	result := make([]pkg, 0, len(pkgs)*len(versions))
+	for _, p := range pkgs {
+		for _, v := range versions {
+			job := p
+			job.index = len(result)
+			job.version = v
+			result = append(result, job)
+		}
+	}
+	return result
+}
+
+// checkoutVersion switches a fetched package over to the version under
+// test, using the package's VCS.
+func checkoutVersion(s *session, idx int, p pkg, dir string, env []string) error {
+	fmt.Fprintf(s.progress, "%04d: %d Checking out version %s\n", p.index, idx, p.version)
+	checkout := exec.Command("git", "checkout", "-q", p.version)
+	checkout.Dir = path.Join(dir, "src", p.slug)
+	checkout.Env = env
+	checkout.Stdout = s.progress
+	checkout.Stderr = s.progress
+	return checkout.Run()
 }
 
 type reply struct {
 	pkg
-	result testResult
-	err_   error
+	result    testResult
+	err_      error
+	diskUsage int64
+	duration  time.Duration
+	logDir    string
+	patches   []patchStatus
+
+	preBuildTime  time.Duration
+	postBuildTime time.Duration
+
+	// how long fetching the package, and running its pre- and post-patch
+	// tests, took
+	fetchTime    time.Duration
+	preTestTime  time.Duration
+	postTestTime time.Duration
+
+	apiChanges  []apiChange
+	shuffleSeed int64
+
+	// how each of the child processes run for the package exited
+	exits []ExitStatus
+
+	// the tests that failed post-patch, and any compiler diagnostics
+	failures    []testFailure
+	diagnostics []diagnostic
+
+	// the panic that aborted the post-patch test binary before any tests
+	// ran, if there was one
+	setupPanic string
+
+	// with --deps, whether the package's tests build any of the patched
+	// packages, and the packages they build post-patch that they didn't
+	// before
+	checkedDeps bool
+	inGraph     bool
+	newDeps     []string
+
+	// how many tests ran pre- and post-patch, if the package got as far
+	// as the post-patch tests
+	testsCounted bool
+	preTests     int
+	postTests    int
+
+	// with --json-parse, how each test went post-patch
+	tests []testOutcome
+
+	// the worker that checked the package
+	worker int
+
+	// a diff of the pre- and post-patch test logs, for packages that
+	// failed post-patch testing, unless --no-diff was given
+	diffLog string
+
+	// exactly which version of the package was fetched, if known
+	resolvedVersion string
+
+	// for a sub-package's row split out of a recursive test, the name of
+	// the package as it was listed
+	listed string
 }
 
-func fetchCode(idx int, p pkg, dir string, timeout time.Duration, env []string) testResult {
-	fmt.Printf("%04d: %d Fetching code...\n", p.index, idx)
-	get := exec.Command("go", "get", "-t", p.slug)
-	get.Env = env
-	get.Stdout = os.Stdout
-	get.Stderr = os.Stderr
+// listedName is the name of the package the reply is for, as it appears in
+// the package list.
+func (r reply) listedName() string {
+	if r.listed != "" {
+		return r.listed
+	}
+	return r.name()
+}
+
+// unsupportedFetch is how recent versions of Go refuse to `go get` in
+// GOPATH mode
+const unsupportedFetch = "is no longer supported outside a module"
+
+func fetchCode(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error) {
+	fmt.Fprintf(s.progress, "%04d: %d Fetching code...\n", p.index, idx)
+	var stderr bytes.Buffer
+	get := goCommand(env, "get", "-t", p.slug)
+	get.Stdout = s.progress
+	get.Stderr = io.MultiWriter(s.progress, &stderr)
+
+	// run the fetch in its own process group so that a timeout can take
+	// down any VCS processes it has spawned along with it
+	if err := s.start(get); err != nil {
+		return fetchFailed, err
+	}
+	defer s.finished(get)
 
 	ch := make(chan error, 1)
-	go func() { ch <- get.Run() }()
+	go func() { ch <- get.Wait() }()
 	select {
 	case err := <-ch:
 		if err == nil {
-			return passed
-		} else {
-			return fetchFailed
+			return passed, nil
+		}
+		if strings.Contains(stderr.String(), unsupportedFetch) {
+			fmt.Fprintf(s.progress, "%04d: %d This version of Go can't fetch outside a module. "+
+				"Test in module mode, or with an older toolchain via --go.\n", p.index, idx)
+			return fetchUnsupported, err
 		}
+		return fetchFailed, err
 
 	case <-time.After(timeout):
-		fmt.Printf("%04d: %d Timed out\n", p.index, idx)
-		get.Process.Kill()
-		return fetchTimedOut
+		fmt.Fprintf(s.progress, "%04d: %d Timed out\n", p.index, idx)
+		syscall.Kill(-get.Process.Pid, syscall.SIGKILL)
+
+		// make sure nothing is still writing into the workdir before we
+		// hand it back for cleanup
+		return fetchTimedOut, <-ch
 	}
 }
 
-func runTests(p pkg, logfile, dir string, env []string) error {
-	file, err := os.Create(path.Join(dir, logfile))
+// resetWorkdir discards anything left behind by a failed fetch, so that a
+// retry starts from an empty GOPATH rather than a half-fetched checkout. The
+// package's temp dir is kept, but emptied.
+func resetWorkdir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	test := exec.Command("go", "test", "-v", p.slug)
-	test.Stdout = file
-	test.Env = env
+	for _, e := range entries {
+		target := path.Join(dir, e.Name())
+		if e.Name() == "tmp" {
+			err = resetWorkdir(target)
+		} else {
+			err = removeTree(target)
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-	return test.Run()
+	return nil
 }
 
-func applyPatch(patchFile, dir string, args *arguments) error {
-	patchFile, err := filepath.Abs(patchFile)
-	if err != nil {
-		return err
-	}
-
-	cmd := exec.Command("patch", "-p1",
-		"-d", path.Join(dir, "src", args.packageName),
-		"-i", patchFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// testTimeout is the error from tests that ran for longer than
+// --test-timeout, and were killed. It keeps the error the kill caused, so
+// that the exit can still be recorded.
+type testTimeout struct {
+	err     error
+	timeout time.Duration
+}
 
-	return cmd.Run()
+func (e testTimeout) Error() string {
+	return fmt.Sprintf("Tests timed out after %s", e.timeout)
 }
 
-func getEnv() []string {
-	env := os.Environ()
-	result := make([]string, 0, len(env))
-	for _, s := range env {
-		if !strings.HasPrefix(s, "GOPATH=") {
-			result = append(result, s)
-		}
-	}
-	return result
+func isTestTimeout(err error) bool {
+	_, ok := err.(testTimeout)
+	return ok
 }
 
-func quickCheck(idx int, p pkg, dir string, args arguments) (testResult, error) {
-	fmt.Printf("%04d: %d Checking out %s into %s\n", p.index, idx, p.slug, dir)
-	err := os.Mkdir(dir, 0755)
+// runTests runs the package's tests, logging their output into logfile. If
+// the tests take longer than timeout they are killed, along with anything
+// they have spawned; the output they wrote before then is still logged. A
+// zero timeout lets them run for as long as they like.
+func runTests(s *session, p pkg, logfile, dir string, env []string, timeout time.Duration, flags ...string) error {
+	file, err := os.Create(path.Join(dir, logfile))
 	if err != nil {
-		return failedUnexpectedly, err
+		return err
 	}
+	defer file.Close()
 
-	env := getEnv()
-	env = append(env, fmt.Sprintf("GOPATH=%s", dir))
+	cmdArgs := append([]string{"test", "-v"}, flags...)
+	test := goCommand(env, append(cmdArgs, p.testPattern())...)
+	if moduleMode(env) {
+		test.Dir = srcDir(env, p.slug)
+	}
+	test.Stdout = file
+	test.Stderr = file
 
-	result := fetchCode(idx, p, dir, args.fetchTimeout, env)
-	if result != passed {
-		fmt.Printf("%04d: %d Failed to fetch code: %s\n",
-			p.index, idx, result.Error())
-		return result, nil
+	// as with fetching, the test binary has to die along with go test
+	if !hasFlag(flags, "-json") {
+		if err := s.start(test); err != nil {
+			return err
+		}
+		defer s.finished(test)
+		return waitTests(test, file, timeout, test.Wait)
 	}
 
-	fmt.Printf("%04d: %d Running pre-patch tests\n", p.index, idx)
-	err = runTests(p, "pre-test.log", dir, env)
+	// keep the event stream, but also give the usual verbose log for
+	// anyone reading the logs
+	jsonFile, err := os.Create(path.Join(dir, jsonLogName(logfile)))
 	if err != nil {
-		fmt.Printf("%04d: %d Failed pre-patch tests. No further testing.\n", p.index, idx)
-		return failedPrePatchTest, nil
+		return err
 	}
+	defer jsonFile.Close()
 
-	fmt.Printf("%04d: %d Applying patch\n", p.index, idx)
-	err = applyPatch("mock.patch", dir, &args)
+	test.Stdout = nil
+	stdout, err := test.StdoutPipe()
 	if err != nil {
-		fmt.Printf("%04d: %d Failed to apply patch. Bailing our.\n", p.index, idx)
-		return patchFailed, nil
+		return err
+	}
+	if err := s.start(test); err != nil {
+		return err
 	}
+	defer s.finished(test)
+	return waitTests(test, file, timeout, func() error {
+		decodeErr := decodeTestJSON(stdout, jsonFile, file)
+		err := test.Wait()
+		if err == nil {
+			err = decodeErr
+		}
+		return err
+	})
+}
 
-	fmt.Printf("%04d: %d Running post-patch tests\n", p.index, idx)
-	err = runTests(p, "post-test.log", dir, env)
-	if err != nil {
-		fmt.Printf("%04d: %d Failed post-patch tests: %s.\n", p.index, idx, err.Error())
-		return failedPostPatchTest, nil
+// waitTests waits for a test process that's been started, killing its
+// process group if it runs for longer than timeout.
+func waitTests(test *exec.Cmd, log io.Writer, timeout time.Duration, wait func() error) error {
+	if timeout == 0 {
+		return wait()
 	}
 
-	fmt.Printf("%04d: %d Passed.\n", p.index, idx)
+	ch := make(chan error, 1)
+	go func() { ch <- wait() }()
+	select {
+	case err := <-ch:
+		return err
+
+	case <-time.After(timeout):
+		syscall.Kill(-test.Process.Pid, syscall.SIGKILL)
 
-	return passed, nil
+		// once wait returns, everything written before the kill has been
+		// copied into the log
+		err := <-ch
+		fmt.Fprintf(log, "\nimpact: killed after %s\n", timeout)
+		return testTimeout{err: err, timeout: timeout}
+	}
 }
 
-func loadPackageList(filename string) ([]string, error) {
-	file, err := os.Open(filename)
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+var errPatchNotApplicable = errors.New("Patch has nothing to apply to")
+
+// patchedFiles lists the pre-existing files that a patch modifies, relative
+// to the directory the patch is applied in once strip leading path
+// components are removed. Files the patch creates from scratch are not
+// included.
+func patchedFiles(patchFile string, strip int) ([]string, error) {
+	file, err := os.Open(patchFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	pkgs := make([]string, 0)
+	targets := make([]string, 0)
 	s := bufio.NewScanner(file)
 	for s.Scan() {
-		if s.Err() != nil {
-			return nil, err
+		line := s.Text()
+		if !strings.HasPrefix(line, "--- ") {
+			continue
 		}
-		pkgs = append(pkgs, strings.TrimSpace(s.Text()))
-	}
 
-	return pkgs, nil
-}
+		name := strings.TrimPrefix(line, "--- ")
+		if i := strings.IndexByte(name, '\t'); i >= 0 {
+			name = name[:i]
+		}
+		name = strings.TrimSpace(name)
+		if name == "/dev/null" {
+			continue
+		}
 
-type arguments struct {
-	fetchTimeout    time.Duration
-	reportFile      string
-	patchFile       string
-	packageName     string
-	packageListFile string
-	concurrency     int
-}
+		// strip the leading path components, as per `patch -p<strip>`
+		for n := 0; n < strip; n++ {
+			i := strings.IndexByte(name, '/')
+			if i < 0 {
+				break
+			}
+			name = name[i+1:]
+		}
+		targets = append(targets, name)
+	}
 
-func parseArgs() (arguments, error) {
-	var result arguments
+	return targets, s.Err()
+}
 
-	flags := pflag.NewFlagSet("Impact", pflag.ContinueOnError)
-	flags.StringVarP(&result.packageName, "package", "p", "",
-		"The package to test. Paths in the patch file must be relative to this.")
-	flags.StringVarP(&result.packageListFile, "package-file", "f", "packages.txt",
-		"The file containing the list of packages to test")
-	flags.StringVarP(&result.patchFile, "delta", "d", "delta.patch",
-		"A patch describing the change to test")
-	flags.DurationVarP(&result.fetchTimeout, "timeout", "t", 60*time.Minute,
-		"How long to wait for the source code fetch befor giving up.")
-	flags.StringVarP(&result.reportFile, "report", "r", "report.txt",
-		"How long to wait for the source code frtch befor giving up.")
-	flags.IntVarP(&result.concurrency, "concurrency", "n", 8,
-		"How many tests to run simultaneously")
+// patchApplies decides whether a patch has anything to modify in pkgDir,
+// so that a package that simply doesn't contain the patched code can be
+// told apart from one where the patch conflicts.
+func patchApplies(patchFile, pkgDir string, strip int) (bool, error) {
+	if _, err := os.Stat(pkgDir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
 
-	err := flags.Parse(os.Args[1:])
+	files, err := patchedFiles(patchFile, strip)
 	if err != nil {
-		return result, err
+		return false, err
 	}
 
-	if result.packageName == "" {
-		return result, errors.New("Must specify a package to test")
+	if len(files) == 0 {
+		return true, nil
 	}
 
-	result.packageListFile, err = filepath.Abs(result.packageListFile)
-	if err != nil {
-		return result, err
+	for _, t := range files {
+		if _, err := os.Stat(path.Join(pkgDir, t)); err == nil {
+			return true, nil
+		}
 	}
 
-	result.patchFile, err = filepath.Abs(result.patchFile)
-	if err != nil {
-		return result, err
-	}
+	return false, nil
+}
 
-	result.reportFile, err = filepath.Abs(result.reportFile)
+// retryTests runs the package's tests, re-running them on failure as
+// dictated by the test phase's retry policy. It reports whether the tests
+// were retried, along with the outcome of the last run.
+func retryTests(s *session, idx int, p pkg, logfile, dir string, env []string, policy retryPolicy, timeout time.Duration, flags ...string) (bool, error) {
+	var err error
+	retried := false
+	policy.retry(func(n int) bool {
+		if n > 0 {
+			retried = true
+			fmt.Fprintf(s.progress, "%04d: %d Re-running tests (%d)\n", p.index, idx, n)
+		}
+		err = runTests(s, p, logfile, dir, env, timeout, flags...)
 
-	return result, err
+		// tests that hung once will most likely hang again
+		return err == nil || isTestTimeout(err) || s.isStopped()
+	})
+	return retried, err
 }
 
-func getResult(result map[testResult]int, r testResult) int {
-	if val, ok := result[r]; ok {
-		return val
-	} else {
-		return 0
+// rerunTests re-runs failing post-patch tests up to n times, logging each
+// run into its own numbered log, and reports whether any of them passed.
+func rerunTests(s *session, idx int, p pkg, dir string, env []string, n int, timeout time.Duration, flags ...string) bool {
+	for i := 1; i <= n && !s.isStopped(); i++ {
+		fmt.Fprintf(s.progress, "%04d: %d Re-running post-patch tests (%d of %d)\n", p.index, idx, i, n)
+		err := runTests(s, p, fmt.Sprintf("post-test-rerun-%d.log", i), dir, env, timeout, flags...)
+		if err == nil {
+			fmt.Fprintf(s.progress, "%04d: %d Post-patch tests passed on rerun %d. Flaky.\n", p.index, idx, i)
+			return true
+		}
 	}
+	return false
 }
 
-func resultCode(r testResult) string {
-	switch r {
-	case fetchTimedOut:
-		return "FT"
+// target pairs a package with the patch to apply to it.
+type target struct {
+	packageName string
+	patchFile   string
 
-	case fetchFailed:
-		return "FF"
+	// whether to name the patch in the report, because it came from the
+	// patch map or is one of a series applied to the same package
+	named bool
+}
 
-	case failedPrePatchTest:
-		return "F1"
+// patchStatus records the outcome of applying the patch for one target.
+type patchStatus struct {
+	packageName string
+	result      testResult
 
-	case failedPostPatchTest:
-		return "F2"
+	// how many of the patch's hunks there were, and how many of them were
+	// rejected, if the patch failed
+	hunks    int
+	rejected int
+	rejects  []rejectedHunk
 
-	case failedUnexpectedly:
-		return "F?"
+	// the patch applied, if it came from the patch map or a series of
+	// --deltas rather than a single one
+	patchFile string
 
-	case patchFailed:
-		return "FP"
+	// the replace directive applied, if it was a replacement rather than a
+	// patch
+	replace string
 
-	case passed:
-		return "P!"
+	// whether a failed patch disagreed with the files it patched over line
+	// endings, which likely explains the failure
+	lineEndings bool
+}
 
-	default:
-		panic(fmt.Sprintf("Invalid test result value: %d", r))
-	}
+// partial reports whether a failed patch applied some of its hunks.
+func (s patchStatus) partial() bool {
+	return s.result == patchFailed && s.rejected > 0 && s.rejected < s.hunks
 }
 
-func writeReport(filename string, results []reply) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+func (s patchStatus) String() string {
+	status := "applied"
+	switch s.result {
+	case patchFailed:
+		causes := make([]string, 0, 2)
+		if s.rejected > 0 {
+			causes = append(causes, fmt.Sprintf("%d/%d hunks rejected", s.rejected, s.hunks))
+		}
+		if s.lineEndings {
+			causes = append(causes, "line endings differ")
+		}
 
-	for _, r := range results {
-		fmt.Fprintf(file, "%04d, %s, %s, ", r.index, resultCode(r.result), r.slug)
-		if r.err_ != nil {
-			fmt.Fprintf(file, `"%s"`, r.err_.Error())
+		status = "failed"
+		if len(causes) > 0 {
+			status = fmt.Sprintf("failed(%s)", strings.Join(causes, ", "))
 		}
-		fmt.Fprintln(file, "")
-	}
 
-	return nil
-}
+	case patchNotApplicable:
+		status = "n/a"
 
-func run() int {
-	args, err := parseArgs()
-	if err != nil {
-		fmt.Println(err.Error())
-		return 1
+	case notInGraph:
+		status = "not-in-graph"
 	}
-
-	fmt.Printf("Loading packages from %s\n", args.packageListFile)
-	packages, err := loadPackageList(args.packageListFile)
-	if err != nil {
-		fmt.Printf("Failed to load pkgs: %s\n", err.Error())
-		return 1
+	if s.replace != "" {
+		return fmt.Sprintf("%s=%s", s.replace, status)
 	}
+	if s.patchFile != "" {
+		return fmt.Sprintf("%s[%s]=%s", s.packageName, filepath.Base(s.patchFile), status)
+	}
+	return fmt.Sprintf("%s=%s", s.packageName, status)
+}
 
-	pkgChan := make(chan pkg, 10)
-	rpyChan := make(chan reply, 10)
-	done := make(chan os.Signal, 1)
+// applyPatches applies the patch for each target in turn, recording how
+// each one went in the reply. It gives up at the first patch that fails to
+// apply. A package counts as patched if at least one target applied.
+func applyPatches(s *session, idx int, rpy *reply, dir string, env []string, args *arguments) testResult {
+	applied := 0
+	if args.replace != nil {
+		err := applyReplace(s, idx, rpy.pkg, args.replace, dir, env)
+		if err != errPatchNotApplicable && err != errNotInGraph {
+			rpy.recordExit("replace", err)
+		}
 
-	signal.Notify(done, os.Interrupt)
+		status := patchStatus{packageName: args.replace.module, result: passed, replace: args.replace.String()}
+		switch {
+		case err == errPatchNotApplicable:
+			status.result = patchNotApplicable
 
-	results := make([]reply, 0, len(packages))
-	summary := make(map[testResult]int)
+		case err == errNotInGraph:
+			status.result = notInGraph
+
+		case err != nil:
+			status.result = patchFailed
 
-	fmt.Printf("Testing %d packages\n", len(packages))
+		default:
+			applied++
+		}
+		rpy.patches = append(rpy.patches, status)
 
-	collate := func() {
-		replies := 0
+		if status.result == patchFailed {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to resolve %s. Bailing our.\n", rpy.index, idx, args.replace)
+			return patchFailed
+		}
+	}
 
-		for reply := range rpyChan {
-			fmt.Printf("%04d: Processing result\n", reply.index)
+	if moduleMode(env) {
+		if err := localizeTargets(s, idx, rpy.pkg, args.targetsFor(rpy.pkg), dir, env); err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to copy patch targets out of the module cache: %s\n",
+				rpy.index, idx, err.Error())
+			return failedUnexpectedly
+		}
+	}
 
-			results = append(results, reply)
+	for _, t := range args.targetsFor(rpy.pkg) {
+		pkgDir := path.Join(dir, "src", t.packageName)
+		var before exportedAPI
+		if args.apiDiff {
+			before, _ = scanAPI(pkgDir)
+		}
 
-			count, _ := summary[reply.result]
-			summary[reply.result] = count + 1
+		err := applyPatch(s, t, dir, args)
+		if err != errPatchNotApplicable {
+			rpy.recordExit("patch:"+t.packageName, err)
+		}
 
-			replies++
-			fmt.Printf("Processed %d/%d replies\n", replies, len(packages))
+		if args.apiDiff && err == nil {
+			after, scanErr := scanAPI(pkgDir)
+			if scanErr == nil {
+				rpy.apiChanges = append(rpy.apiChanges, diffAPI(t.packageName, before, after))
+			}
+		}
 
-			if replies == len(packages) {
-				done <- syscall.SIGQUIT
+		status := patchStatus{packageName: t.packageName, result: passed}
+		if t.named {
+			status.patchFile = t.patchFile
+		}
+		switch {
+		case err == errPatchNotApplicable:
+			status.result = patchNotApplicable
+
+		case err != nil:
+			status.result = patchFailed
+			status.hunks, _ = countHunks(t.patchFile)
+			status.rejected, _ = countRejectedHunks(pkgDir)
+			status.rejects, _ = rejectedHunks(pkgDir)
+			for _, h := range status.rejects {
+				fmt.Fprintf(s.progress, "%04d: %d Rejected hunk %s\n", rpy.index, idx, h)
 			}
+			status.lineEndings = lineEndingMismatch(t.patchFile, pkgDir, args.strip)
+
+		default:
+			applied++
+		}
+		rpy.patches = append(rpy.patches, status)
+
+		if status.result == patchFailed {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to apply %s to %s. Bailing our.\n",
+				rpy.index, idx, filepath.Base(t.patchFile), t.packageName)
+			return patchFailed
 		}
 	}
-	go collate()
 
-	test := func(i int) {
-		for pkgInfo := range pkgChan {
-			workdir, err := filepath.Abs(fmt.Sprintf("%04d", pkgInfo.index))
-			result := failedUnexpectedly
-			if err == nil {
-				result, err = quickCheck(i, pkgInfo, workdir, args)
-			}
-			rpyChan <- reply{pkg: pkgInfo, result: result, err_: err}
+	if applied == 0 {
+		if len(rpy.patches) > 0 && rpy.patches[0].result == notInGraph {
+			return notInGraph
+		}
+		return patchNotApplicable
+	}
+	return passed
+}
+
+func applyPatch(s *session, t target, dir string, args *arguments) error {
+	patchFile := t.patchFile
+	pkgDir := path.Join(dir, "src", t.packageName)
+	if args.normalizeLineEndings {
+		normalized, err := normalizeLineEndings(patchFile, pkgDir, path.Join(dir, "tmp"), args.strip)
+		if err != nil {
+			return err
 		}
+		defer os.Remove(normalized)
+		patchFile = normalized
+	}
+	if args.applyCmd != "" {
+		return runApplyCmd(s, args.applyCmd, patchFile, pkgDir)
 	}
 
-	// fork the workers
-	for i := 0; i < args.concurrency; i++ {
-		go test(i)
+	ok, err := patchApplies(patchFile, pkgDir, args.strip)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errPatchNotApplicable
 	}
 
-	// start feeding the packages to the workers...
-	for i, slug := range packages {
-		pkgChan <- pkg{index: i, slug: slug}
+	if args.patchTool == patchToolGit {
+		return gitApply(s, patchFile, pkgDir, args.strip)
 	}
 
-	// wait for the user to signal "time's up"
-	<-done
+	cmd := exec.Command("patch", fmt.Sprintf("-p%d", args.strip),
+		"-d", pkgDir,
+		"-i", patchFile)
+	cmd.Stdout = s.progress
+	cmd.Stderr = s.progress
+
+	return cmd.Run()
+}
+
+// The tools a patch can be applied with.
+const (
+	patchToolPatch = "patch"
+	patchToolGit   = "git"
+)
+
+// gitApply applies a patch with git apply, which, unlike patch(1),
+// understands git's renames, mode changes and binary diffs. Like patch, it
+// leaves .rej files behind for the hunks it rejects. Paths in the patch are
+// relative to pkgDir, so git mustn't go looking for a repository above it,
+// which it would take them to be relative to instead.
+func gitApply(s *session, patchFile, pkgDir string, strip int) error {
+	cmd := exec.Command("git", "apply", fmt.Sprintf("-p%d", strip), "--reject", patchFile)
+	cmd.Dir = pkgDir
+	cmd.Env = setEnv(os.Environ(), "GIT_CEILING_DIRECTORIES", path.Dir(pkgDir))
+	cmd.Stdout = s.progress
+	cmd.Stderr = s.progress
+
+	return cmd.Run()
+}
+
+// applyCmdVars are the values available to an --apply-cmd template.
+type applyCmdVars struct {
+	Dir   string
+	Patch string
+}
+
+// runApplyCmd replaces the built-in patch application with a user-supplied
+// shell command, rendered from a template that can refer to the target
+// package directory as {{.Dir}} and the patch file as {{.Patch}}. The
+// command signals success or failure via its exit code.
+func runApplyCmd(s *session, cmdTemplate, patchFile, pkgDir string) error {
+	if _, err := os.Stat(pkgDir); os.IsNotExist(err) {
+		return errPatchNotApplicable
+	}
 
-	fmt.Printf("Tested %d packages\n", len(packages))
-	fmt.Printf("\t%d fetch timed out\n", getResult(summary, fetchTimedOut))
-	fmt.Printf("\t%d failed fetching\n", getResult(summary, fetchFailed))
-	fmt.Printf("\t%d failed pre-patch testing\n", getResult(summary, failedPrePatchTest))
-	fmt.Printf("\t%d failed post-patch testing\n", getResult(summary, failedPostPatchTest))
-	fmt.Printf("\t%d failed in unexpected ways\n", getResult(summary, failedUnexpectedly))
-	fmt.Printf("\t%d passed testing\n", getResult(summary, passed))
+	tmpl, err := template.New("apply-cmd").Parse(cmdTemplate)
+	if err != nil {
+		return err
+	}
 
-	err = writeReport(args.reportFile, results)
+	var script bytes.Buffer
+	err = tmpl.Execute(&script, applyCmdVars{Dir: pkgDir, Patch: patchFile})
 	if err != nil {
-		fmt.Printf("Failed to write test report: %s\n", err.Error())
-		return 1
+		return err
 	}
 
-	return 0
+	cmd := exec.Command("sh", "-c", script.String())
+	cmd.Dir = pkgDir
+	cmd.Stdout = s.progress
+	cmd.Stderr = s.progress
+
+	return cmd.Run()
+}
+
+var tmpEnvVars = []string{"TMPDIR", "TMP", "TEMP", "GOTMPDIR"}
+
+// isolatedEnvVars lists the variables that quickCheck sets per package, or
+// that default to somewhere in the package's GOPATH, and so must not be
+// inherited from the parent environment.
+var isolatedEnvVars = append([]string{"GOPATH", "GOMODCACHE"}, tmpEnvVars...)
+
+func getEnv() []string {
+	env := os.Environ()
+	result := make([]string, 0, len(env))
+	for _, s := range env {
+		if !isIsolated(s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func isIsolated(envVar string) bool {
+	for _, name := range isolatedEnvVars {
+		if strings.HasPrefix(envVar, name+"=") {
+			return true
+		}
+	}
+	return false
 }
 
-func main() {
-	os.Exit(run())
+// outcome summarises the error from a phase for the event log.
+func outcome(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// fetch fetches the package's code into the workdir, retrying as the fetch
+// phase's retry policy dictates.
+func (r *Runner) fetch(idx int, rpy *reply, dir string, env []string) testResult {
+	s := r.session
+	p := rpy.pkg
+	var result testResult
+	r.args.retry[fetchPhase].retry(func(n int) bool {
+		if n > 0 {
+			fmt.Fprintf(s.progress, "%04d: %d Retrying fetch (%d)\n", p.index, idx, n)
+			if err := resetWorkdir(dir); err != nil {
+				fmt.Fprintf(s.progress, "%04d: %d Failed to reset workdir: %s\n", p.index, idx, err.Error())
+				return false
+			}
+		}
+		r.events.emit(p, idx, "fetch-start", "")
+		var err error
+		result, err = p.fetcher().Fetch(s, idx, p, dir, r.args.fetchTimeout, env)
+
+		// in module mode, go get fetches the version itself
+		fetchedVersion := moduleMode(env) && p.fetch == nil
+		if result == passed && p.version != "" && !fetchedVersion {
+			err = checkoutVersion(s, idx, p, dir, env)
+			if err != nil {
+				result = fetchFailed
+			}
+		}
+		r.events.emitExit(p, idx, "fetch-end", resultCode(result), rpy.recordExit("fetch", err))
+		if result == passed {
+			rpy.resolvedVersion = resolvedVersion(p, dir, env)
+		}
+
+		// no amount of retrying will make the toolchain support the fetch
+		return result == passed || result == fetchUnsupported || s.isStopped()
+	})
+	return result
+}
+
+func (r *Runner) quickCheck(idx int, rpy *reply, dir string) (testResult, error) {
+	result, err := r.checkout(idx, rpy, dir)
+	if result != passed || err != nil {
+		return result, err
+	}
+	return r.test(idx, rpy, dir)
+}
+
+// makeTmpDir gives each package its own temp dir so that tests writing
+// fixtures to predictable temp paths don't collide across workers.
+func makeTmpDir(dir string) (string, error) {
+	tmpDir := path.Join(dir, "tmp")
+	return tmpDir, os.Mkdir(tmpDir, 0755)
+}
+
+// checkEnv sets up the environment to run the go tool in for a package,
+// and the one to run its tests in, which adds the package's own variables.
+// --goproxy only applies once the package has been fetched.
+func (r *Runner) checkEnv(p pkg, dir, tmpDir string, fetched bool) (env, testEnv []string) {
+	args := r.args
+	env = getEnv()
+	if args.goFlags != "" {
+		env = setEnv(env, "GOFLAGS", args.goFlags)
+	}
+	if args.goProxy != "" && fetched {
+		env = setEnv(env, "GOPROXY", args.goProxy)
+	}
+	env = append(env, fmt.Sprintf("GOPATH=%s", dir))
+	for _, name := range tmpEnvVars {
+		env = append(env, fmt.Sprintf("%s=%s", name, tmpDir))
+	}
+	if args.goRoot != "" {
+		env = useToolchain(env, args.goRoot)
+	}
+	if args.mode == modeModule {
+		env = moduleEnv(env)
+	}
+	if args.sharedModCache != "" {
+		env = sharedModCacheEnv(env, args.sharedModCache)
+	}
+
+	testEnv = env
+	for _, v := range p.env {
+		kv := strings.SplitN(v, "=", 2)
+		testEnv = setEnv(testEnv, kv[0], kv[1])
+	}
+	return env, testEnv
+}
+
+// checkout creates the package's workdir and fetches its code into it,
+// from the checkout cache if it can.
+func (r *Runner) checkout(idx int, rpy *reply, dir string) (testResult, error) {
+	s := r.session
+	p := rpy.pkg
+	fmt.Fprintf(s.progress, "%04d: %d Checking out %s into %s\n", p.index, idx, p.name(), dir)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return failedUnexpectedly, err
+	}
+
+	if rpy.logDir != dir {
+		err = os.MkdirAll(rpy.logDir, 0755)
+		if err != nil {
+			return failedUnexpectedly, err
+		}
+	}
+
+	tmpDir, err := makeTmpDir(dir)
+	if err != nil {
+		return failedUnexpectedly, err
+	}
+	defer removeTree(tmpDir)
+	env, _ := r.checkEnv(p, dir, tmpDir, false)
+
+	var result testResult
+	cached := false
+	fetchStart := time.Now()
+	if r.cache != nil {
+		cached, err = r.cache.restore(p.name(), dir)
+		if err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to restore cached checkout: %s\n", p.index, idx, err.Error())
+			cached = false
+			if err := resetWorkdir(dir); err != nil {
+				return failedUnexpectedly, err
+			}
+		}
+	}
+
+	if cached {
+		fmt.Fprintf(s.progress, "%04d: %d Using cached checkout\n", p.index, idx)
+		result = passed
+
+		// only the sources are cached, so a module's dependencies still
+		// have to be downloaded into the workdir's module cache
+		if moduleMode(env) {
+			result, err = fetchDeps(s, idx, p, dir, r.args.fetchTimeout, env)
+			rpy.recordExit("fetch", err)
+		}
+	} else {
+		result = r.fetch(idx, rpy, dir, env)
+	}
+	rpy.fetchTime = time.Since(fetchStart)
+	if result != passed {
+		fmt.Fprintf(s.progress, "%04d: %d Failed to fetch code: %s\n",
+			p.index, idx, result.Error())
+		return result, nil
+	}
+
+	if r.cache != nil && !cached {
+		if err := r.cache.store(p.name(), dir); err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to cache checkout: %s\n", p.index, idx, err.Error())
+		}
+	}
+	return passed, nil
+}
+
+// test runs the pre-patch tests, patches, and runs the post-patch tests on
+// a package that's been checked out into dir.
+func (r *Runner) test(idx int, rpy *reply, dir string) (testResult, error) {
+	s := r.session
+	args, events := r.args, r.events
+	p := rpy.pkg
+	logDir := rpy.logDir
+
+	tmpDir, err := makeTmpDir(dir)
+	if err != nil {
+		return failedUnexpectedly, err
+	}
+	defer removeTree(tmpDir)
+	env, testEnv := r.checkEnv(p, dir, tmpDir, true)
+
+	rpy.diskUsage, err = diskUsage(dir)
+	if err != nil {
+		return failedUnexpectedly, err
+	}
+
+	// building is far more memory hungry than fetching, so only let as many
+	// packages into the build/test phase as memory allows
+	r.buildSlots <- struct{}{}
+	defer func() { <-r.buildSlots }()
+
+	exclusions := append(append([]string{}, args.excludeTests...), p.excludeTests...)
+	excluded, err := excludeTestFiles(path.Join(dir, "src", p.slug), exclusions)
+	defer restoreTestFiles(excluded)
+	if err != nil {
+		return failedUnexpectedly, err
+	}
+	if len(excluded) > 0 {
+		fmt.Fprintf(s.progress, "%04d: %d Excluded %d test files\n", p.index, idx, len(excluded))
+	}
+
+	if args.leakCheck {
+		leakFile, err := injectLeakCheck(path.Join(dir, "src", p.slug))
+		if err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Can't check for leaks: %s\n", p.index, idx, err.Error())
+		} else if leakFile != "" {
+			defer os.Remove(leakFile)
+		}
+	}
+
+	if args.buildTimes {
+		rpy.preBuildTime = measureBuild(s, idx, p, "pre", logDir, env)
+	}
+
+	var preDeps map[string]bool
+	if args.deps {
+		preDeps, err = listDeps(p, dir, testEnv)
+		if err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to list pre-patch dependencies: %s\n", p.index, idx, err.Error())
+		}
+	}
+
+	// flags common to every test run, so the pre- and post-patch runs stay
+	// comparable
+	testFlags := make([]string, 0)
+	if args.short {
+		testFlags = append(testFlags, "-short")
+	}
+	if args.jsonParse {
+		testFlags = append(testFlags, "-json")
+	}
+	if args.race {
+		testFlags = append(testFlags, "-race")
+	}
+	if focus, ok := args.focusTests[p.slug]; ok {
+		testFlags = append(testFlags, "-run", focus)
+	}
+
+	fmt.Fprintf(s.progress, "%04d: %d Running pre-patch tests\n", p.index, idx)
+	events.emit(p, idx, "pre-test-start", "")
+	preStart := time.Now()
+	_, err = retryTests(s, idx, p, "pre-test.log", logDir, testEnv, args.retry[testPhase], args.testTimeout, testFlags...)
+	rpy.preTestTime = time.Since(preStart)
+	events.emitExit(p, idx, "pre-test-end", outcome(err), rpy.recordExit("pre-test", err))
+	if isTestTimeout(err) {
+		// the patch can't be blamed for tests that hang without it
+		fmt.Fprintf(s.progress, "%04d: %d Pre-patch tests timed out after %s. No further testing.\n",
+			p.index, idx, args.testTimeout)
+		return failedPrePatchTest, err
+	}
+	err = args.aggregate(p, path.Join(logDir, "pre-test.log"), err, true)
+	if err != nil {
+		fmt.Fprintf(s.progress, "%04d: %d Failed pre-patch tests. No further testing.\n", p.index, idx)
+		return failedPrePatchTest, nil
+	}
+	if args.maxPackageTime > 0 && rpy.preTestTime > args.maxPackageTime {
+		fmt.Fprintf(s.progress, "%04d: %d Pre-patch tests took %s. Skipping.\n",
+			p.index, idx, rpy.preTestTime.Round(time.Second))
+		return skippedTooSlow, nil
+	}
+
+	fmt.Fprintf(s.progress, "%04d: %d Applying patch\n", p.index, idx)
+	events.emit(p, idx, "patch-start", "")
+	result := applyPatches(s, idx, rpy, dir, env, &args)
+	events.emit(p, idx, "patch-end", resultCode(result))
+	if result == patchNotApplicable {
+		fmt.Fprintf(s.progress, "%04d: %d Patch has nothing to apply to. Reporting baseline only.\n", p.index, idx)
+		return patchNotApplicable, nil
+	}
+	if result != passed {
+		return result, nil
+	}
+
+	if preDeps != nil {
+		postDeps, err := listDeps(p, dir, testEnv)
+		if err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Failed to list post-patch dependencies: %s\n", p.index, idx, err.Error())
+		} else {
+			targets := args.targetsFor(p)
+			rpy.checkedDeps = true
+			rpy.inGraph = dependsOn(preDeps, targets) || dependsOn(postDeps, targets)
+			rpy.newDeps = addedDeps(preDeps, postDeps)
+			if !rpy.inGraph {
+				fmt.Fprintf(s.progress, "%04d: %d Doesn't build any of the patched packages\n", p.index, idx)
+			}
+			if len(rpy.newDeps) > 0 {
+				fmt.Fprintf(s.progress, "%04d: %d Builds %d new packages post-patch\n", p.index, idx, len(rpy.newDeps))
+			}
+		}
+	}
+
+	// the rest of the patch still reaches the package, so it's tested
+	// anyway, and only a pass is put down to the shadowing
+	shadowed, err := shadowedTargets(p, args.targetsFor(p), args.strip, dir, env)
+	if err != nil {
+		return failedUnexpectedly, err
+	}
+	if len(shadowed) > 0 {
+		fmt.Fprintf(s.progress, "%04d: %d Patch changes go.mod of %s, but the package's selected version won't see it.\n",
+			p.index, idx, strings.Join(shadowed, ", "))
+	}
+
+	if args.generate {
+		fmt.Fprintf(s.progress, "%04d: %d Running go generate\n", p.index, idx)
+		events.emit(p, idx, "generate-start", "")
+		err = runGenerate(p, path.Join(logDir, "generate.log"), dir, testEnv)
+		events.emitExit(p, idx, "generate-end", outcome(err), rpy.recordExit("generate", err))
+		if err != nil {
+			fmt.Fprintf(s.progress, "%04d: %d Failed go generate: %s.\n", p.index, idx, err.Error())
+			return generateFailed, nil
+		}
+	}
+
+	if args.buildTimes {
+		rpy.postBuildTime = measureBuild(s, idx, p, "post", logDir, env)
+	}
+
+	fmt.Fprintf(s.progress, "%04d: %d Running post-patch tests\n", p.index, idx)
+	postFlags := append([]string{}, testFlags...)
+	if args.shuffle {
+		rpy.shuffleSeed = args.shuffleSeed
+		postFlags = append(postFlags, fmt.Sprintf("-shuffle=%d", args.shuffleSeed))
+	}
+
+	events.emit(p, idx, "post-test-start", "")
+	postStart := time.Now()
+	retried, err := retryTests(s, idx, p, "post-test.log", logDir, testEnv, args.retry[testPhase], args.testTimeout, postFlags...)
+	rpy.postTestTime = time.Since(postStart)
+	events.emitExit(p, idx, "post-test-end", outcome(err), rpy.recordExit("post-test", err))
+	if isTestTimeout(err) {
+		fmt.Fprintf(s.progress, "%04d: %d Post-patch tests timed out after %s.\n", p.index, idx, args.testTimeout)
+		return testTimedOut, nil
+	}
+	err = args.aggregate(p, path.Join(logDir, "post-test.log"), err, false)
+	if args.verifyTwice {
+		// only trust the outcome if a second run agrees with it
+		fmt.Fprintf(s.progress, "%04d: %d Re-running post-patch tests to verify\n", p.index, idx)
+		again := runTests(s, p, "post-test-verify.log", logDir, testEnv, args.testTimeout, postFlags...)
+		if (err == nil) != (again == nil) {
+			fmt.Fprintf(s.progress, "%04d: %d Post-patch test runs disagreed.\n", p.index, idx)
+			return nondeterministic, nil
+		}
+	}
+
+	pre, logErr := parseTestLog(path.Join(logDir, "pre-test.log"))
+	if logErr != nil {
+		return failedUnexpectedly, logErr
+	}
+	post, logErr := parseTestLog(path.Join(logDir, "post-test.log"))
+	if logErr != nil {
+		return failedUnexpectedly, logErr
+	}
+	rpy.testsCounted = true
+	rpy.preTests, rpy.postTests = pre.run, post.run
+	if args.jsonParse {
+		rpy.tests, logErr = testOutcomes(path.Join(logDir, jsonLogName("post-test.log")))
+		if logErr != nil {
+			return failedUnexpectedly, logErr
+		}
+	}
+
+	if err != nil {
+		var diagErr error
+		rpy.diagnostics, diagErr = parseDiagnostics(path.Join(logDir, "post-test.log"))
+		if diagErr != nil {
+			return failedUnexpectedly, diagErr
+		}
+
+		cycle, logErr := logContains(path.Join(logDir, "post-test.log"), "import cycle not allowed")
+		if logErr != nil {
+			return failedUnexpectedly, logErr
+		}
+		if cycle {
+			fmt.Fprintf(s.progress, "%04d: %d Patch introduced an import cycle.\n", p.index, idx)
+			return importCycle, nil
+		}
+
+		// a test binary that panics before running a single test (but did
+		// build) has been broken in TestMain or an init function, and has
+		// no failing tests to name
+		if post.run == 0 && len(rpy.diagnostics) == 0 {
+			rpy.setupPanic, logErr = panicTrace(path.Join(logDir, "post-test.log"))
+			if logErr != nil {
+				return failedUnexpectedly, logErr
+			}
+			if rpy.setupPanic != "" {
+				fmt.Fprintf(s.progress, "%04d: %d Failed post-patch test setup, before running any tests.\n", p.index, idx)
+				return testSetupFailed, nil
+			}
+		}
+
+		if args.shuffle {
+			// find out whether it's the shuffling that breaks the tests
+			fmt.Fprintf(s.progress, "%04d: %d Re-running post-patch tests unshuffled\n", p.index, idx)
+			unshuffled := runTests(s, p, "post-test-unshuffled.log", logDir, testEnv, args.testTimeout, testFlags...)
+			if unshuffled == nil {
+				fmt.Fprintf(s.progress, "%04d: %d Failed post-patch tests only when shuffled (seed %d).\n",
+					p.index, idx, args.shuffleSeed)
+				return orderDependent, nil
+			}
+		}
+
+		fmt.Fprintf(s.progress, "%04d: %d Failed post-patch tests: %s.\n", p.index, idx, err.Error())
+		rpy.failures, err = parseFailures(path.Join(logDir, "post-test.log"))
+		if err != nil {
+			return failedUnexpectedly, err
+		}
+
+		if args.rerun > 0 && rerunTests(s, idx, p, logDir, testEnv, args.rerun, args.testTimeout, postFlags...) {
+			return flakyTests, nil
+		}
+
+		if !args.noDiff {
+			diffFile := path.Join(logDir, "diff.log")
+			err = diffLogs(s, path.Join(logDir, "pre-test.log"), path.Join(logDir, "post-test.log"), diffFile)
+			if err != nil {
+				fmt.Fprintf(s.progress, "%04d: %d Failed to diff test logs: %s\n", p.index, idx, err.Error())
+			} else {
+				rpy.diffLog = diffFile
+			}
+		}
+		return failedPostPatchTest, nil
+	}
+
+	// a retry that passes is as flaky as a rerun that does
+	if retried {
+		fmt.Fprintf(s.progress, "%04d: %d Post-patch tests passed on a retry. Flaky.\n", p.index, idx)
+		return flakyTests, nil
+	}
+
+	if len(shadowed) > 0 {
+		fmt.Fprintf(s.progress, "%04d: %d Passed, but didn't see the patch's go.mod changes.\n", p.index, idx)
+		return versionShadowed, nil
+	}
+
+	// a package without any tests passes whatever the patch does to it,
+	// so long as it still builds
+	if post.run == 0 && post.noTestFiles {
+		fmt.Fprintf(s.progress, "%04d: %d Passed, but has no test files.\n", p.index, idx)
+		return noTests, nil
+	}
+
+	if skippedMore(pre, post, args.skipThreshold) {
+		fmt.Fprintf(s.progress, "%04d: %d Passed, but skipped %d tests (was %d) and ran %d (was %d).\n",
+			p.index, idx, post.skipped, pre.skipped, post.run, pre.run)
+		return testsSilentlySkipped, nil
+	}
+
+	if args.leakCheck {
+		preLeaks, err := parseLeakCheck(path.Join(logDir, "pre-test.log"))
+		if err != nil {
+			return failedUnexpectedly, err
+		}
+		postLeaks, err := parseLeakCheck(path.Join(logDir, "post-test.log"))
+		if err != nil {
+			return failedUnexpectedly, err
+		}
+		if leaksMore(preLeaks, postLeaks) {
+			fmt.Fprintf(s.progress, "%04d: %d Passed, but left %d goroutines and %d files open (was %d and %d).\n",
+				p.index, idx, postLeaks.goroutines, postLeaks.fds, preLeaks.goroutines, preLeaks.fds)
+			return resourceLeak, nil
+		}
+	}
+
+	if args.buildTimes && buildSlowdown(*rpy) > args.buildTimeThreshold {
+		fmt.Fprintf(s.progress, "%04d: %d Passed, but build time went from %s to %s.\n",
+			p.index, idx, rpy.preBuildTime, rpy.postBuildTime)
+		return buildTimeRegressed, nil
+	}
+
+	fmt.Fprintf(s.progress, "%04d: %d Passed.\n", p.index, idx)
+
+	return passed, nil
+}
+
+// loadPackageList reads the package list, from stdin if filename is "-".
+// Blank lines, and comments starting with #, are skipped.
+func loadPackageList(filename string) ([]string, error) {
+	in := io.Reader(os.Stdin)
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	pkgs := make([]string, 0)
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pkgs = append(pkgs, line)
+	}
+
+	return pkgs, s.Err()
+}
+
+// parsePackage interprets a line from the package list. Each line holds a
+// package slug, optionally followed by annotations:
+//
+//	ENV:NAME=value   sets an environment variable when testing the package
+//	EXCLUDE:pattern  excludes matching test files when testing the package
+//	FETCH:git=url[@ref]  clones the package from a git repository
+//	FETCH:copy=path  copies the package from a local directory
+func parsePackage(index int, line string) (pkg, error) {
+	p := pkg{index: index}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return p, nil
+	}
+
+	// a package can be pinned to a version, as slug@version
+	p.slug = fields[0]
+	if i := strings.LastIndex(p.slug, "@"); i >= 0 {
+		p.slug, p.version = p.slug[:i], p.slug[i+1:]
+		if p.slug == "" || p.version == "" {
+			return p, fmt.Errorf("%s: expected slug@version", fields[0])
+		}
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "ENV:"):
+			v := strings.TrimPrefix(f, "ENV:")
+			if !strings.Contains(v, "=") || strings.HasPrefix(v, "=") {
+				return p, fmt.Errorf("%s: invalid environment annotation %q", p.slug, f)
+			}
+			p.env = append(p.env, v)
+
+		case strings.HasPrefix(f, "EXCLUDE:"):
+			pattern := strings.TrimPrefix(f, "EXCLUDE:")
+			if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+				return p, fmt.Errorf("%s: invalid exclusion %q", p.slug, f)
+			}
+			p.excludeTests = append(p.excludeTests, pattern)
+
+		case strings.HasPrefix(f, "FETCH:"):
+			fetch, err := parseFetcher(strings.TrimPrefix(f, "FETCH:"))
+			if err != nil {
+				return p, fmt.Errorf("%s: %s", p.slug, err.Error())
+			}
+			p.fetch = fetch
+
+		default:
+			return p, fmt.Errorf("%s: unrecognised annotation %q", p.slug, f)
+		}
+	}
+
+	return p, nil
+}
+
+// stringList is a command line flag value that collects every occurrence
+// of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type arguments struct {
+	fetchTimeout    time.Duration
+	reportFile      string
+	reportFormat    string
+	mode            string
+	sharedModCache  string
+	goProxy         string
+	goFlags         string
+	targets         []target
+	patchMapFile    string
+	patchMap        map[string]string
+	replaceWith     string
+	replace         *moduleReplace
+	packageListFile string
+	packageList     []string
+	concurrency     int
+
+	// with --two-phase, how many packages to fetch at once, and how many
+	// to test at once
+	twoPhase         bool
+	fetchConcurrency int
+	testConcurrency  int
+
+	popularityURL   string
+	popularityCache string
+	retry           retryPolicies
+	fetchRetries    int
+	fetchRetryDelay time.Duration
+	skipThreshold   int
+	strict          bool
+	eventLogFile    string
+	applyCmd        string
+	patchTool       string
+	strip           int
+
+	confirmBaseline     bool
+	baselineSample      int
+	baselineMaxFailures float64
+
+	sqliteFile  string
+	runTag      string
+	minPassRate float64
+	outputDir   string
+	workRoot    string
+	logRoot     string
+	logLinkDir  string
+	buildMemory int
+
+	buildTimes         bool
+	buildTimeThreshold float64
+
+	goRoot   string
+	goBinary string
+	apiDiff  bool
+
+	cacheDir        string
+	cacheMaxSize    byteSize
+	cleanCacheAfter bool
+
+	shuffle     bool
+	shuffleSeed int64
+	short       bool
+	race        bool
+	verifyTwice bool
+	rerun       int
+
+	recursive   bool
+	aggregation string
+
+	heartbeat      time.Duration
+	deps           bool
+	maxPackageTime time.Duration
+	maxRuntime     time.Duration
+	failFast       bool
+	testTimeout    time.Duration
+	jsonParse      bool
+	continueRun    bool
+	checkpointFile string
+	noDiff         bool
+	keepWorkdirs   bool
+	dryRun         bool
+
+	focusTestsFile string
+	focusTests     map[string]string
+	focusOnly      bool
+
+	normalizeLineEndings bool
+	logFormat            string
+	colorMode            string
+	color                bool
+	generate             bool
+	rejectStandard       bool
+
+	sample     float64
+	sampleSeed int64
+	leakCheck  bool
+
+	retainLogsClasses string
+	retainLogs        map[testResult]bool
+
+	impactWeights impactWeights
+	selfCheck     int
+
+	dependentsCacheFile string
+	dependentsTTL       time.Duration
+	refreshDependents   bool
+
+	excludeTests  stringList
+	versionMatrix stringList
+
+	githubChecksFile string
+	githubRepo       string
+	githubSHA        string
+}
+
+func parseArgs(argv []string) (arguments, error) {
+	var result arguments
+	result.retry = make(retryPolicies)
+	result.impactWeights = defaultImpactWeights()
+
+	flags := pflag.NewFlagSet("Impact", pflag.ContinueOnError)
+	var packageNames, patchFiles stringList
+	flags.VarP(&packageNames, "package", "p",
+		"The package to test. Paths in the patch file must be relative to this. "+
+			"May be repeated, pairing each package with a --delta in order.")
+	flags.StringVarP(&result.packageListFile, "package-file", "f", "packages.txt",
+		"The file containing the list of packages to test, or - to read it from stdin")
+	flags.VarP(&patchFiles, "delta", "d",
+		"A patch describing the change to test (default \"delta.patch\"). With a single --package, "+
+			"may be repeated to apply a series of patches in the order given.")
+	flags.DurationVarP(&result.fetchTimeout, "timeout", "t", 60*time.Minute,
+		"How long to wait for the source code fetch befor giving up.")
+	flags.StringVar(&result.replaceWith, "replace-with", "",
+		"Build packages with a module=repo@ref replace directive, in place of or as well as patches")
+	flags.StringVar(&result.patchMapFile, "patch-map", "",
+		"A file of \"slug patchfile\" lines giving packages their own patch in place of --delta")
+	flags.StringVarP(&result.reportFile, "report", "r", "",
+		"The file to write the report to. Defaults to report.txt (or .json, or .xml), in the output dir if there is one.")
+	flags.StringVar(&result.goProxy, "goproxy", "",
+		"A GOPROXY to use once each package has been fetched, for patching and testing it, "+
+			"e.g. off to stop the tests downloading anything")
+	flags.StringVar(&result.goFlags, "goflags", "",
+		"GOFLAGS to run the go tool with, in place of any in the environment")
+	flags.StringVar(&result.sharedModCache, "shared-mod-cache", "",
+		"A module cache for all packages to share, so that each module is only downloaded once. "+
+			"Each package still gets its own source to patch.")
+	flags.StringVar(&result.mode, "mode", modeGOPATH,
+		"How to fetch and build packages: gopath, or module to use Go modules")
+	flags.StringVar(&result.reportFormat, "report-format", reportFormatText,
+		"The format to write the report in: text, json or junit")
+	flags.StringVar(&result.githubChecksFile, "github-checks", "",
+		"A file to write the results to as GitHub check run output, with annotations")
+	flags.StringVar(&result.githubRepo, "github-repo", "",
+		"An owner/repo to publish the results to as a check run, using $GITHUB_TOKEN")
+	flags.StringVar(&result.githubSHA, "github-sha", "",
+		"The commit to attach the --github-repo check run to")
+	flags.Var(&result.versionMatrix, "version-matrix",
+		"Test every package at each of these versions (VCS refs). May be repeated.")
+	flags.Var(&result.excludeTests, "exclude-tests",
+		"A pattern matching test files to exclude from every package's tests. May be repeated.")
+	flags.Var(&result.impactWeights, "impact-weights",
+		"How much each component counts towards the impact score, as component=weight. "+
+			"Components are regressions, tests, builds and popularity.")
+	flags.IntVar(&result.selfCheck, "self-check", 0,
+		"Before the run, check this many packages twice on different workers, "+
+			"and give up if their results differ")
+	flags.StringVar(&result.dependentsCacheFile, "dependents-cache", "",
+		"A file for caching which packages depend on the patched module. Packages that "+
+			"don't are skipped on later runs against the same package list.")
+	flags.DurationVar(&result.dependentsTTL, "dependents-ttl", 7*24*time.Hour,
+		"How long cached dependents stay fresh. Zero keeps them forever.")
+	flags.BoolVar(&result.refreshDependents, "refresh-dependents", false,
+		"Ignore cached dependents, recomputing and caching them afresh")
+	flags.StringVar(&result.retainLogsClasses, "retain-logs", "all",
+		"The results to keep logs for: result codes, or all, warnings or regressions. "+
+			"Regressions' logs are always kept.")
+	flags.BoolVar(&result.leakCheck, "leak-check", false,
+		"Count the goroutines and open files left behind by each package's tests, "+
+			"warning if the patch leaves more")
+	flags.Float64Var(&result.sample, "sample", 0,
+		"Test a random sample of this fraction of the packages, weighted by popularity if known, "+
+			"and estimate the regression rate across all of them")
+	flags.Int64Var(&result.sampleSeed, "sample-seed", 0,
+		"The seed for --sample. Defaults to a random seed, which is printed.")
+	flags.BoolVar(&result.rejectStandard, "reject-std", false,
+		"Refuse a package list with standard library packages in it, rather than skipping them")
+	flags.BoolVar(&result.generate, "generate", false,
+		"Run go generate in each package after patching it, before the post-patch tests")
+	flags.StringVar(&result.logFormat, "log-format", logFormatVerbose,
+		"How to log progress: verbose, compact for a single line per package, "+
+			"or json for a JSON object per phase transition")
+	flags.StringVar(&result.logFormat, "progress", logFormatVerbose,
+		"The same as --log-format")
+	flags.StringVar(&result.colorMode, "color", colorAuto,
+		"Whether to colour result codes and, with --log-format compact, keep a running count: "+
+			"auto when stdout is a terminal, always or never")
+	flags.BoolVar(&result.normalizeLineEndings, "normalize-line-endings", false,
+		"Convert the patch and the files it patches to LF line endings before patching")
+	flags.StringVar(&result.focusTestsFile, "focus-tests", "",
+		"A file of \"slug regexp\" lines limiting the tests run in those packages, as with -run")
+	flags.BoolVar(&result.focusOnly, "focus-only", false,
+		"Skip the packages not listed in --focus-tests, rather than testing them fully")
+	flags.BoolVar(&result.continueRun, "continue", false,
+		"Continue an interrupted run where it left off, from the state it keeps in the work root")
+	flags.BoolVar(&result.jsonParse, "json-parse", false,
+		"Run tests with -json and read results from the event stream rather than the verbose log")
+	flags.DurationVar(&result.testTimeout, "test-timeout", 0,
+		"Kill each package's test run if it takes longer than this. "+
+			"Zero lets tests run for as long as they like.")
+	flags.DurationVar(&result.maxRuntime, "max-runtime", 0,
+		"Stop starting packages after this long, reporting those not yet tested as skipped")
+	flags.BoolVar(&result.failFast, "fail-fast", false,
+		"Stop at the first regression, reporting the packages not yet tested as skipped")
+	flags.DurationVar(&result.maxPackageTime, "max-package-time", 0,
+		"Skip the post-patch tests of packages whose pre-patch tests take longer than this")
+	flags.BoolVar(&result.deps, "deps", false,
+		"List the packages each package's tests build, pre- and post-patch, to check they use the patched code")
+	flags.DurationVar(&result.heartbeat, "heartbeat", 0,
+		"Print a line saying the run is still going at this interval, for CI systems that kill silent jobs")
+	flags.BoolVar(&result.recursive, "recursive", false,
+		"Test each package's sub-packages along with it, as <slug>/...")
+	flags.StringVar(&result.aggregation, "aggregate", aggregateAnyFail,
+		"How --recursive rolls sub-package results up: any-fail, root-only or report-all")
+	flags.BoolVar(&result.verifyTwice, "verify-twice", false,
+		"Run the post-patch tests twice, reporting packages whose runs disagree as nondeterministic")
+	flags.IntVar(&result.rerun, "rerun", 0,
+		"Re-run failing post-patch tests up to this many times, reporting packages that pass on any rerun as flaky")
+	flags.BoolVar(&result.race, "race", false,
+		"Run tests with the race detector. Race builds take a lot more memory, so consider "+
+			"lowering --concurrency or raising --build-memory.")
+	flags.BoolVar(&result.short, "short", false,
+		"Run tests with -short, skipping slow tests for a faster, less thorough pass")
+	flags.BoolVar(&result.shuffle, "shuffle", false,
+		"Shuffle the order of the post-patch tests to expose order dependence")
+	flags.Int64Var(&result.shuffleSeed, "shuffle-seed", 0,
+		"The seed for --shuffle. Defaults to a random seed, which is recorded in the report.")
+	flags.StringVar(&result.cacheDir, "cache-dir", "",
+		"A directory to cache fetched checkouts in, for reuse by later runs")
+	flags.BoolVar(&result.cleanCacheAfter, "clean-cache-after", false,
+		"Remove the --shared-mod-cache and every package's module cache once the run is done. "+
+			"The --cache-dir checkout cache is kept.")
+	flags.Var(&result.cacheMaxSize, "cache-max-size",
+		"The most disk the checkout cache may use, e.g. 20G. Least recently used "+
+			"checkouts are evicted to stay within it. Unlimited by default.")
+	flags.BoolVar(&result.apiDiff, "api-diff", false,
+		"Compare the patched package's exported API before and after patching")
+	flags.StringVar(&result.goRoot, "go", "",
+		"The root of the Go toolchain to fetch, build and test with, e.g. a forked Go")
+	flags.StringVar(&result.goBinary, "go-binary", "go",
+		"The go binary to fetch, build and test with, as an alternative to --go")
+	flags.BoolVar(&result.buildTimes, "build-times", false,
+		"Time a full build of each package before and after the patch")
+	flags.Float64Var(&result.buildTimeThreshold, "build-time-threshold", 0.25,
+		"The fractional build time increase that --build-times reports as a regression")
+	flags.IntVar(&result.buildMemory, "build-memory", 0,
+		"Estimated MiB needed to build and test one package. If set, limits "+
+			"how many packages build at once based on available memory.")
+	flags.StringVar(&result.outputDir, "output-dir", "",
+		"A directory to gather all of the run's outputs in")
+	flags.StringVar(&result.logLinkDir, "log-dir", "",
+		"A directory to link each package's logs into as they finish, in a subdirectory named "+
+			"after the package with its slashes turned into commas")
+	flags.IntVarP(&result.concurrency, "concurrency", "n", 8,
+		"How many tests to run simultaneously")
+	flags.BoolVar(&result.twoPhase, "two-phase", false,
+		"Fetch every package before testing any of them, with separate concurrency for each phase")
+	flags.IntVar(&result.fetchConcurrency, "fetch-concurrency", 0,
+		"With --two-phase, how many packages to fetch simultaneously. Defaults to --concurrency.")
+	flags.IntVar(&result.testConcurrency, "test-concurrency", 0,
+		"With --two-phase, how many packages to test simultaneously. Defaults to --concurrency.")
+	flags.Var(result.retry, "retry",
+		"Retry policy for a phase, as phase=count[:backoff]. Phases are "+
+			"\"fetch\" and \"test\"; patch failures are never retried. "+
+			"Post-patch tests that only pass on a retry are reported as flaky.")
+	flags.IntVar(&result.fetchRetries, "fetch-retries", -1,
+		"How many times to retry a failed or timed out fetch. Shorthand for --retry fetch=N:delay.")
+	flags.DurationVar(&result.fetchRetryDelay, "fetch-retry-delay", 0,
+		"How long to wait before retrying a fetch, doubling after each retry")
+	flags.BoolVar(&result.dryRun, "dry-run", false,
+		"Check the package list and patches, and list what would be tested, without testing it")
+	flags.BoolVar(&result.keepWorkdirs, "keep-workdirs", false,
+		"Keep the workdirs of packages that passed, rather than removing them once they're done")
+	flags.BoolVar(&result.noDiff, "no-diff", false,
+		"Don't diff the pre- and post-patch test logs of packages that fail post-patch testing")
+	flags.StringVar(&result.checkpointFile, "checkpoint", "",
+		"A file to record each package's result in as it completes. If the file already exists, "+
+			"the run carries on from it, skipping the packages it records.")
+	flags.StringVar(&result.patchTool, "patch-tool", patchToolPatch,
+		"The tool to apply patches with: patch, or git to use git apply")
+	flags.IntVar(&result.strip, "strip", 1,
+		"The number of leading path components to strip from the patch's file names, as per patch -p")
+	flags.StringVar(&result.applyCmd, "apply-cmd", "",
+		"A shell command to run instead of patch(1) to apply the change. "+
+			"{{.Dir}} and {{.Patch}} expand to the package directory and patch file.")
+	flags.BoolVar(&result.confirmBaseline, "confirm-clean-baseline", false,
+		"Abort the run if too many of the first packages fail their pre-patch tests")
+	flags.IntVar(&result.baselineSample, "baseline-sample", 20,
+		"How many packages --confirm-clean-baseline checks before deciding")
+	flags.Float64Var(&result.baselineMaxFailures, "baseline-max-failures", 0.5,
+		"The fraction of pre-patch failures --confirm-clean-baseline tolerates")
+	flags.Float64Var(&result.minPassRate, "min-pass-rate", 0,
+		"Fail the run if fewer than this fraction of testable packages pass post-patch, "+
+			"rather than on any regression")
+	flags.StringVar(&result.runTag, "run-tag", "",
+		"A tag identifying this run in all of its outputs. Defaults to a timestamp.")
+	flags.StringVar(&result.sqliteFile, "sqlite", "",
+		"A SQLite database to append this run's results to")
+	flags.StringVar(&result.eventLogFile, "event-log", "",
+		"A file to record every phase transition in, as JSON")
+	flags.BoolVar(&result.strict, "strict", false,
+		"Also fail the run if any package produced a warning, failed pre-patch testing or couldn't be fetched")
+	flags.IntVar(&result.skipThreshold, "skip-threshold", 5,
+		"How many more tests must be skipped post-patch before a passing package is flagged. "+
+			"The default of 5 tolerates the odd test that skips itself depending on the machine; 0 turns the check off.")
+	flags.StringVar(&result.popularityURL, "popularity-url", "",
+		"An endpoint reporting how many packages import a given package. "+
+			"\"{slug}\" is replaced with the package being looked up.")
+	flags.StringVar(&result.popularityCache, "popularity-cache", "",
+		"A file for caching importer counts between runs")
+
+	err := flags.Parse(argv)
+	if err != nil {
+		return result, err
+	}
+
+	if result.replaceWith != "" {
+		result.replace, err = parseReplace(result.replaceWith)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if len(packageNames) == 0 && result.replace == nil {
+		return result, errors.New("Must specify a package to test")
+	}
+
+	if len(patchFiles) == 0 && len(packageNames) == 1 {
+		patchFiles = stringList{"delta.patch"}
+	}
+
+	// a single package can take a series of patches, applied in order
+	series := len(packageNames) == 1 && len(patchFiles) > 1
+	if series {
+		for len(packageNames) < len(patchFiles) {
+			packageNames = append(packageNames, packageNames[0])
+		}
+	}
+
+	if len(patchFiles) != len(packageNames) {
+		return result, fmt.Errorf("Got %d packages but %d patches; each --package needs a --delta",
+			len(packageNames), len(patchFiles))
+	}
+
+	for i, name := range packageNames {
+		patchFile, err := filepath.Abs(patchFiles[i])
+		if err != nil {
+			return result, err
+		}
+		result.targets = append(result.targets, target{packageName: name, patchFile: patchFile, named: series})
+	}
+
+	switch result.logFormat {
+	case logFormatVerbose, logFormatCompact, logFormatJSON:
+	default:
+		return result, fmt.Errorf("Unknown log format %q; expected %s, %s or %s",
+			result.logFormat, logFormatVerbose, logFormatCompact, logFormatJSON)
+	}
+
+	switch result.colorMode {
+	case colorAuto, colorAlways, colorNever:
+	default:
+		return result, fmt.Errorf("Unknown --color setting %q; expected %s, %s or %s",
+			result.colorMode, colorAuto, colorAlways, colorNever)
+	}
+	result.color = wantColor(result.colorMode, os.Stdout)
+
+	result.retainLogs, err = parseRetention(result.retainLogsClasses)
+	if err != nil {
+		return result, err
+	}
+
+	if err := validAggregation(result.aggregation); err != nil {
+		return result, err
+	}
+
+	if result.focusTestsFile != "" {
+		result.focusTests, err = loadFocusTests(result.focusTestsFile)
+		if err != nil {
+			return result, fmt.Errorf("Failed to load focus tests: %s", err.Error())
+		}
+	} else if result.focusOnly {
+		return result, errors.New("--focus-only requires --focus-tests")
+	}
+
+	if result.patchMapFile != "" {
+		if len(result.targets) != 1 {
+			return result, errors.New("--patch-map needs exactly one --package to patch")
+		}
+		result.patchMap, err = loadPatchMap(result.patchMapFile)
+		if err != nil {
+			return result, fmt.Errorf("Failed to load patch map: %s", err.Error())
+		}
+	}
+
+	if result.fetchRetries >= 0 || result.fetchRetryDelay > 0 {
+		if _, ok := result.retry[fetchPhase]; ok {
+			return result, errors.New("--fetch-retries and --fetch-retry-delay can't be used with --retry fetch=...")
+		}
+		if result.fetchRetries < 0 {
+			return result, errors.New("--fetch-retry-delay needs --fetch-retries")
+		}
+		result.retry[fetchPhase] = retryPolicy{retries: result.fetchRetries, backoff: result.fetchRetryDelay}
+	}
+
+	if result.patchTool != patchToolPatch && result.patchTool != patchToolGit {
+		return result, fmt.Errorf("Unknown --patch-tool %q; expected patch or git", result.patchTool)
+	}
+	if result.strip < 0 {
+		return result, errors.New("--strip must not be negative")
+	}
+	if result.rerun < 0 {
+		return result, errors.New("--rerun must not be negative")
+	}
+
+	if result.applyCmd != "" {
+		_, err = template.New("apply-cmd").Parse(result.applyCmd)
+		if err != nil {
+			return result, fmt.Errorf("Invalid --apply-cmd template: %s", err.Error())
+		}
+	}
+
+	if result.goBinary != "go" {
+		if result.goRoot != "" {
+			return result, errors.New("--go and --go-binary can't be used together")
+		}
+		result.goRoot, err = toolchainRoot(result.goBinary)
+		if err != nil {
+			return result, fmt.Errorf("Can't find the toolchain of %s: %s", result.goBinary, err.Error())
+		}
+	}
+
+	if result.goRoot != "" {
+		result.goRoot, err = filepath.Abs(result.goRoot)
+		if err != nil {
+			return result, err
+		}
+
+		if _, err := os.Stat(path.Join(result.goRoot, "bin", "go")); err != nil {
+			return result, fmt.Errorf("No go binary in toolchain %s: %s", result.goRoot, err.Error())
+		}
+	}
+
+	if result.githubRepo != "" && result.githubSHA == "" {
+		return result, errors.New("--github-repo requires --github-sha")
+	}
+
+	if result.sample < 0 || result.sample > 1 {
+		return result, errors.New("--sample must be a fraction between 0 and 1")
+	}
+	if result.sample > 0 && result.sampleSeed == 0 {
+		result.sampleSeed = time.Now().UnixNano()
+	}
+
+	if !result.twoPhase && (result.fetchConcurrency != 0 || result.testConcurrency != 0) {
+		return result, errors.New("--fetch-concurrency and --test-concurrency need --two-phase")
+	}
+	if result.fetchConcurrency == 0 {
+		result.fetchConcurrency = result.concurrency
+	}
+	if result.testConcurrency == 0 {
+		result.testConcurrency = result.concurrency
+	}
+	if result.twoPhase && result.selfCheck > 0 && result.testConcurrency < 2 {
+		return result, errors.New("--self-check needs a --test-concurrency of at least 2")
+	}
+	if result.selfCheck > 0 && result.concurrency < 2 {
+		return result, errors.New("--self-check needs a --concurrency of at least 2")
+	}
+
+	// the dependency graph is what the dependents cache is filled from
+	if result.dependentsCacheFile != "" {
+		result.deps = true
+	}
+
+	if result.shuffle && result.shuffleSeed == 0 {
+		result.shuffleSeed = time.Now().UnixNano()
+	}
+
+	if result.runTag == "" {
+		result.runTag = time.Now().UTC().Format("20060102T150405Z")
+	}
+
+	if result.packageListFile != "-" {
+		result.packageListFile, err = filepath.Abs(result.packageListFile)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.sharedModCache != "" {
+		result.sharedModCache, err = filepath.Abs(result.sharedModCache)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.checkpointFile != "" {
+		result.checkpointFile, err = filepath.Abs(result.checkpointFile)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.logLinkDir != "" {
+		result.logLinkDir, err = filepath.Abs(result.logLinkDir)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.workRoot = "."
+	if result.outputDir != "" {
+		result.outputDir, err = filepath.Abs(result.outputDir)
+		if err != nil {
+			return result, err
+		}
+		result.workRoot = path.Join(result.outputDir, "artifacts")
+		result.logRoot = path.Join(result.outputDir, "logs")
+	}
+
+	if result.mode != modeGOPATH && result.mode != modeModule {
+		return result, fmt.Errorf("Unknown --mode %q; expected gopath or module", result.mode)
+	}
+
+	switch result.reportFormat {
+	case reportFormatText:
+		if result.reportFile == "" {
+			result.reportFile = path.Join(result.outputDir, "report.txt")
+		}
+
+	case reportFormatJSON:
+		if result.reportFile == "" {
+			result.reportFile = path.Join(result.outputDir, "report.json")
+		}
+
+	case reportFormatJUnit:
+		if result.reportFile == "" {
+			result.reportFile = path.Join(result.outputDir, "report.xml")
+		}
+
+	default:
+		return result, fmt.Errorf("Unknown --report-format %q; expected text, json or junit", result.reportFormat)
+	}
+
+	result.reportFile, err = filepath.Abs(result.reportFile)
+
+	return result, err
+}
+
+// baselineFailureRate is the fraction of results that failed their
+// pre-patch tests.
+func baselineFailureRate(results []reply) float64 {
+	if len(results) == 0 {
+		return 0
+	}
+
+	failures := 0
+	for _, r := range results {
+		if r.result == failedPrePatchTest {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(results))
+}
+
+func getResult(result map[testResult]int, r testResult) int {
+	if val, ok := result[r]; ok {
+		return val
+	} else {
+		return 0
+	}
+}
+
+// isRegression reports whether a result means the patch broke the package.
+func isRegression(r testResult) bool {
+	switch r {
+	case failedPostPatchTest, patchFailed, importCycle, testSetupFailed, generateFailed, testTimedOut:
+		return true
+	}
+	return false
+}
+
+// isStrictFailure reports whether a result that doesn't reflect on the
+// patch should still fail a --strict run: the package couldn't be fetched,
+// or was already failing.
+func isStrictFailure(r testResult) bool {
+	switch r {
+	case fetchTimedOut, fetchFailed, fetchUnsupported, failedPrePatchTest:
+		return true
+	}
+	return false
+}
+
+// isTestable reports whether a result says anything about the patch, as
+// opposed to the package failing for reasons of its own (or of the
+// infrastructure) before the patch could be tested.
+func isTestable(r testResult) bool {
+	return r == passed || isWarning(r) || isRegression(r)
+}
+
+// passRate is the fraction of testable packages that passed post-patch,
+// warnings included.
+func passRate(summary map[testResult]int) (float64, int) {
+	testable, passing := 0, 0
+	for r, count := range summary {
+		if !isTestable(r) {
+			continue
+		}
+		testable += count
+		if !isRegression(r) {
+			passing += count
+		}
+	}
+
+	if testable == 0 {
+		return 1, 0
+	}
+	return float64(passing) / float64(testable), testable
+}
+
+// isWarning reports whether a result is a pass with something suspicious
+// about it. Warnings only fail a run in strict mode.
+func isWarning(r testResult) bool {
+	switch r {
+	case testsSilentlySkipped, buildTimeRegressed, orderDependent, nondeterministic, versionShadowed,
+		resourceLeak, flakyTests:
+		return true
+	}
+	return false
+}
+
+func resultCode(r testResult) string {
+	switch r {
+	case fetchTimedOut:
+		return "FT"
+
+	case fetchFailed:
+		return "FF"
+
+	case failedPrePatchTest:
+		return "F1"
+
+	case failedPostPatchTest:
+		return "F2"
+
+	case failedUnexpectedly:
+		return "F?"
+
+	case patchFailed:
+		return "FP"
+
+	case patchNotApplicable:
+		return "NA"
+
+	case testsSilentlySkipped:
+		return "WS"
+
+	case importCycle:
+		return "FC"
+
+	case buildTimeRegressed:
+		return "WB"
+
+	case orderDependent:
+		return "WO"
+
+	case testSetupFailed:
+		return "FS"
+
+	case nondeterministic:
+		return "WN"
+
+	case fetchUnsupported:
+		return "FU"
+
+	case versionShadowed:
+		return "WV"
+
+	case skippedTooSlow:
+		return "SS"
+
+	case generateFailed:
+		return "FG"
+
+	case notExternal:
+		return "NE"
+
+	case resourceLeak:
+		return "WL"
+
+	case notInGraph:
+		return "NG"
+
+	case testTimedOut:
+		return "FK"
+
+	case skippedOutOfTime:
+		return "ST"
+
+	case noTests:
+		return "NT"
+
+	case flakyTests:
+		return "WF"
+
+	case skippedFailFast:
+		return "SF"
+
+	case passed:
+		return "P!"
+
+	default:
+		panic(fmt.Sprintf("Invalid test result value: %d", r))
+	}
+}
+
+// run carries out a run, calling onResult with each result as it comes in,
+// and returns the summary of results along with the process exit code.
+func run(ctx context.Context, args arguments, onResult func(reply)) (map[testResult]int, int) {
+	var err error
+	summary := make(map[testResult]int)
+	out := args.console()
+
+	if args.outputDir != "" {
+		err = prepareOutputDir(args.outputDir)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to create output dir: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	for _, f := range []string{args.reportFile, args.eventLogFile, args.sqliteFile, args.githubChecksFile} {
+		if f == "" {
+			continue
+		}
+		if err := checkWritable(f); err != nil {
+			fmt.Fprintf(out, "Can't write output: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	packages := args.packageList
+	if packages == nil {
+		fmt.Fprintf(out, "Loading packages from %s\n", args.packageListFile)
+		packages, err = loadPackageList(args.packageListFile)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to load pkgs: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	pkgs := make([]pkg, 0, len(packages))
+	for i, line := range packages {
+		p, err := parsePackage(i, line)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to load pkgs: %s\n", err.Error())
+			return summary, 1
+		}
+		if p.isStandard() && args.rejectStandard {
+			fmt.Fprintf(out, "Failed to load pkgs: %s is in the standard library\n", p.slug)
+			return summary, 1
+		}
+		p.recursive = args.recursive
+		pkgs = append(pkgs, p)
+	}
+
+	var dependents dependentsCache
+	dependentsCached := false
+	key := dependentsKey(args.patchedModules(), packages)
+	if args.dependentsCacheFile != "" {
+		dependents, err = loadDependentsCache(args.dependentsCacheFile)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to load dependents cache: %s\n", err.Error())
+			return summary, 1
+		}
+
+		if names, computed, ok := dependents.lookup(key, args.dependentsTTL); ok && !args.refreshDependents {
+			dependentsCached = true
+			pkgs = dependentPackages(pkgs, names)
+			fmt.Fprintf(out, "Testing only the %d packages found to depend on %s at %s\n",
+				len(pkgs), strings.Join(args.patchedModules(), ", "), computed.Format(time.RFC3339))
+		}
+	}
+
+	if args.focusOnly {
+		pkgs = focusedPackages(pkgs, args.focusTests)
+		fmt.Fprintf(out, "Testing only the %d packages with focus tests\n", len(pkgs))
+	}
+
+	if len(args.versionMatrix) > 0 {
+		pkgs = expandVersions(pkgs, args.versionMatrix)
+		fmt.Fprintf(out, "Testing %d versions of each package\n", len(args.versionMatrix))
+	}
+
+	// a dry run doesn't look anything up, so any sample is unweighted
+	weighted := false
+	if args.popularityURL != "" && !args.dryRun {
+		fmt.Fprintf(out, "Looking up package popularity\n")
+		err = lookupPopularity(out, pkgs, &args)
+		if err != nil {
+			fmt.Fprintf(out, "Popularity lookup failed, continuing unweighted: %s\n", err.Error())
+		} else {
+			weighted = true
+			byPopularity(pkgs)
+		}
+	}
+
+	var inclusion map[string]float64
+	if args.sample > 0 {
+		total := len(pkgs)
+		pkgs, inclusion = samplePackages(pkgs, args.sample, args.sampleSeed)
+		fmt.Fprintf(out, "Sampled %d of %d packages (seed %d):\n", len(pkgs), total, args.sampleSeed)
+		for _, p := range pkgs {
+			fmt.Fprintf(out, "\t%s\n", p.name())
+		}
+	}
+
+	if args.dryRun {
+		return summary, dryRun(&args, pkgs)
+	}
+
+	// keep track of what's been done, so that the run can be continued if
+	// it dies part way through
+	allPkgs := pkgs
+	statePath := path.Join(args.workRoot, "state.jsonl")
+	if args.checkpointFile != "" {
+		statePath = args.checkpointFile
+		if _, err := os.Stat(statePath); err == nil {
+			args.continueRun = true
+		}
+	}
+	var state *stateLog
+	completed := make([]reply, 0)
+	if args.continueRun {
+		state, args.runTag, completed, err = continueStateLog(statePath)
+		if err != nil {
+			fmt.Fprintf(out, "Can't continue the run: %s\n", err.Error())
+			return summary, 1
+		}
+
+		pkgs, completed = resumePackages(pkgs, completed)
+		for _, p := range pkgs {
+			// anything left by the packages that were in flight
+			err = removeTree(path.Join(args.workRoot, fmt.Sprintf("%04d", p.index)))
+			if err != nil {
+				fmt.Fprintf(out, "Failed to clear workdir: %s\n", err.Error())
+				return summary, 1
+			}
+		}
+		fmt.Fprintf(out, "Continuing run %s: %d packages already done\n", args.runTag, len(completed))
+	} else {
+		state, err = createStateLog(statePath, args.runTag, pkgs)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to create state log: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+	defer state.close()
+
+	results := make([]reply, 0, len(packages))
+	for _, r := range completed {
+		results = append(results, r)
+		summary[r.result]++
+	}
+
+	started := time.Now()
+
+	fmt.Fprintf(out, "Testing %d packages (run %s)\n", len(packages), args.runTag)
+
+	var events *eventLog
+	eventWriters := make([]io.Writer, 0, 2)
+	if args.logFormat == logFormatJSON {
+		eventWriters = append(eventWriters, os.Stdout)
+	}
+	if args.eventLogFile != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if args.continueRun {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		file, err := os.OpenFile(args.eventLogFile, flags, 0644)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to create event log: %s\n", err.Error())
+			return summary, 1
+		}
+		defer file.Close()
+
+		eventWriters = append(eventWriters, file)
+	}
+	if len(eventWriters) > 0 {
+		events = newEventLog(io.MultiWriter(eventWriters...), args.runTag)
+	}
+
+	// the caller's cancelling the run is told apart from its giving up on
+	// its own
+	interrupted := ctx.Done()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runner := newRunner(args)
+	if args.cacheDir != "" {
+		runner.cache, err = newCheckoutCache(args.cacheDir, args.mode, int64(args.cacheMaxSize))
+		if err != nil {
+			fmt.Fprintf(out, "Failed to create checkout cache: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	if args.selfCheck > 0 {
+		fmt.Fprintf(out, "Self-checking %d packages on two workers each\n", args.selfCheck)
+		mismatches, err := selfCheck(ctx, runner, pkgs, args.selfCheck, args.workRoot)
+		if err != nil {
+			fmt.Fprintf(out, "Self-check failed: %s\n", err.Error())
+			return summary, 1
+		}
+		if len(mismatches) > 0 {
+			fmt.Fprintf(out, "SELF-CHECK FAILED: workers disagree, so results can't be trusted:\n\t%s\n",
+				strings.Join(mismatches, "\n\t"))
+			return summary, 1
+		}
+		fmt.Fprintf(out, "Self-check passed\n")
+	}
+
+	// the self-check's packages aren't part of the run, so stay out of
+	// the event log
+	runner.events = events
+	replies := runner.stream(ctx, pkgs)
+
+	// CI systems tend to kill jobs that go quiet, which a slow package's
+	// tests can do for a long time
+	var heartbeat <-chan time.Time
+	if args.heartbeat > 0 {
+		ticker := time.NewTicker(args.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// a nil channel never fires, so without a deadline there's none
+	var deadline <-chan time.Time
+	if args.maxRuntime > 0 {
+		deadline = time.After(args.maxRuntime - time.Since(started))
+	}
+	outOfTime := false
+	failedFast := false
+
+	unhealthy := false
+	var first *firstRegression
+
+collate:
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				break collate
+			}
+
+			fmt.Fprintf(runner.session.progress, "%04d: Processing result\n", reply.index)
+
+			for _, row := range args.reportRows(reply) {
+				results = append(results, row)
+
+				if first == nil && isRegression(row.result) {
+					first = &firstRegression{
+						After:    time.Since(started),
+						Packages: len(results),
+						Slug:     row.name(),
+					}
+				}
+
+				count, _ := summary[row.result]
+				summary[row.result] = count + 1
+
+				if err := state.record(row); err != nil {
+					fmt.Fprintf(out, "Failed to record state: %s\n", err.Error())
+				}
+
+				if onResult != nil {
+					onResult(row)
+				}
+			}
+
+			workdir, _ := filepath.Abs(path.Join(args.workRoot, fmt.Sprintf("%04d", reply.index)))
+			if !args.retainLogs[reply.result] {
+				if err := discardLogs(reply, workdir); err != nil {
+					fmt.Fprintf(out, "%04d: Failed to discard logs: %s\n", reply.index, err.Error())
+				}
+			}
+
+			// only failures are worth investigating, so there's no need to
+			// keep the checkouts of packages that passed
+			if !args.keepWorkdirs && reply.result == passed {
+				if err := removeWorkdir(reply, workdir, args.retainLogs[reply.result]); err != nil {
+					fmt.Fprintf(out, "%04d: Failed to remove workdir: %s\n", reply.index, err.Error())
+				}
+			}
+
+			if args.logLinkDir != "" {
+				if err := linkLogs(reply, args.logLinkDir); err != nil {
+					fmt.Fprintf(out, "%04d: Failed to link logs: %s\n", reply.index, err.Error())
+				}
+			}
+
+			switch {
+			case args.logFormat == logFormatCompact && args.color:
+				// keep a running count on the last line, beneath the results
+				fmt.Fprint(out, clearLine)
+				fmt.Fprintln(out, compactLine(reply, true))
+				fmt.Fprintf(out, "%d/%d done", len(results), len(packages))
+
+			case args.logFormat == logFormatCompact:
+				fmt.Fprintln(out, compactLine(reply, false))
+
+			case args.logFormat == logFormatVerbose && args.color:
+				fmt.Fprintf(out, "Processed %d/%d replies: %s %s\n", len(results), len(packages),
+					colorize(reply.result, resultCode(reply.result)), reply.name())
+
+			case args.logFormat == logFormatVerbose:
+				fmt.Fprintf(out, "Processed %d/%d replies\n", len(results), len(packages))
+			}
+
+			// the packages under way are reported as skipped along with the
+			// rest, so kill them rather than wait for them to finish
+			if args.failFast && isRegression(reply.result) {
+				fmt.Fprintf(out, "%04d: %s regressed: not starting any more packages\n", reply.index, reply.name())
+				failedFast = true
+				cancel()
+				for range replies {
+				}
+				break collate
+			}
+
+			if args.confirmBaseline && len(results) == args.baselineSample {
+				rate := baselineFailureRate(results)
+				if rate > args.baselineMaxFailures {
+					fmt.Fprintf(out, "%.0f%% of the first %d packages failed pre-patch testing: "+
+						"baseline unhealthy — check your environment\n",
+						rate*100, len(results))
+					unhealthy = true
+					cancel()
+					break collate
+				}
+			}
+
+		case <-heartbeat:
+			if args.logFormat == logFormatCompact && args.color {
+				fmt.Fprint(out, clearLine)
+			}
+			fmt.Fprintf(out, "Still working: %d in flight, %d/%d done\n",
+				runner.InFlight(), len(results), len(allPkgs))
+
+		case <-deadline:
+			fmt.Fprintf(out, "Out of time after %s: not starting any more packages\n", args.maxRuntime)
+			outOfTime = true
+
+			// the packages under way are reported as out of time, so kill
+			// them rather than run on past the deadline
+			cancel()
+			for range replies {
+			}
+			break collate
+
+		// the caller has called time. Kill what's under way, and wait for
+		// the workers to wind down, so nothing's left running.
+		case <-interrupted:
+			cancel()
+			for range replies {
+			}
+			break collate
+		}
+	}
+
+	if args.logFormat == logFormatCompact && args.color {
+		fmt.Fprint(out, clearLine)
+	}
+
+	if err := events.close(); err != nil {
+		fmt.Fprintf(out, "Failed to write event log: %s\n", err.Error())
+	}
+
+	// only a full, unfiltered run says which packages don't depend on the
+	// patch
+	if dependents != nil && !dependentsCached && !args.focusOnly && args.sample == 0 &&
+		len(results) == len(allPkgs) {
+		dependents[key] = dependentsEntry{Computed: time.Now().UTC(), Dependents: dependentsOf(results)}
+		if err := saveDependentsCache(args.dependentsCacheFile, dependents); err != nil {
+			fmt.Fprintf(out, "Failed to save dependents cache: %s\n", err.Error())
+		}
+	}
+
+	// report the packages the run didn't get to, including any that were
+	// in flight, so that the report still accounts for every package
+	if outOfTime || failedFast {
+		skipped := skippedOutOfTime
+		if failedFast {
+			skipped = skippedFailFast
+		}
+
+		tested := make(map[int]bool)
+		for _, r := range results {
+			tested[r.index] = true
+		}
+		for _, p := range allPkgs {
+			if !tested[p.index] {
+				results = append(results, reply{pkg: p, result: skipped})
+				summary[skipped]++
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "Tested %d packages\n", len(packages))
+	fmt.Fprintf(out, "\t%d fetch timed out\n", getResult(summary, fetchTimedOut))
+	fmt.Fprintf(out, "\t%d failed fetching\n", getResult(summary, fetchFailed))
+	fmt.Fprintf(out, "\t%d couldn't be fetched outside a module\n", getResult(summary, fetchUnsupported))
+	fmt.Fprintf(out, "\t%d wouldn't see the patch's go.mod changes\n", getResult(summary, versionShadowed))
+	fmt.Fprintf(out, "\t%d skipped as too slow to test\n", getResult(summary, skippedTooSlow))
+	fmt.Fprintf(out, "\t%d failed go generate post-patch\n", getResult(summary, generateFailed))
+	fmt.Fprintf(out, "\t%d skipped as standard library packages\n", getResult(summary, notExternal))
+	fmt.Fprintf(out, "\t%d passed, but leak more post-patch\n", getResult(summary, resourceLeak))
+	fmt.Fprintf(out, "\t%d don't depend on the replaced module\n", getResult(summary, notInGraph))
+	fmt.Fprintf(out, "\t%d timed out post-patch testing\n", getResult(summary, testTimedOut))
+	fmt.Fprintf(out, "\t%d skipped as the run ran out of time\n", getResult(summary, skippedOutOfTime))
+	fmt.Fprintf(out, "\t%d skipped as the run stopped at the first regression\n", getResult(summary, skippedFailFast))
+	fmt.Fprintf(out, "\t%d passed, but have no tests\n", getResult(summary, noTests))
+	fmt.Fprintf(out, "\t%d failed pre-patch testing\n", getResult(summary, failedPrePatchTest))
+	fmt.Fprintf(out, "\t%d failed post-patch testing\n", getResult(summary, failedPostPatchTest))
+	fmt.Fprintf(out, "\t%d failed in unexpected ways\n", getResult(summary, failedUnexpectedly))
+	fmt.Fprintf(out, "\t%d failed due to an import cycle\n", getResult(summary, importCycle))
+	fmt.Fprintf(out, "\t%d failed to apply the patch\n", getResult(summary, patchFailed))
+	fmt.Fprintf(out, "\t%d passed baseline, patch not applicable\n", getResult(summary, patchNotApplicable))
+	fmt.Fprintf(out, "\t%d passed, but ran fewer tests post-patch\n", getResult(summary, testsSilentlySkipped))
+	fmt.Fprintf(out, "\t%d passed, but build more slowly post-patch\n", getResult(summary, buildTimeRegressed))
+	fmt.Fprintf(out, "\t%d failed post-patch testing only when shuffled\n", getResult(summary, orderDependent))
+	fmt.Fprintf(out, "\t%d failed post-patch test setup\n", getResult(summary, testSetupFailed))
+	fmt.Fprintf(out, "\t%d failed post-patch testing, but passed on a rerun\n", getResult(summary, flakyTests))
+	fmt.Fprintf(out, "\t%d gave different results in two post-patch runs\n", getResult(summary, nondeterministic))
+	fmt.Fprintf(out, "\t%d passed testing\n", getResult(summary, passed))
+
+	score, components := impactScore(results, args.impactWeights)
+	breakdown := make([]string, 0, len(components))
+	for _, name := range []string{impactRegressions, impactTests, impactBuilds, impactPopularity} {
+		if value, ok := components[name]; ok {
+			breakdown = append(breakdown, fmt.Sprintf("%s %.2f", name, value))
+		}
+	}
+	fmt.Fprintf(out, "Impact score: %.0f/100 (%s)\n", score, strings.Join(breakdown, ", "))
+
+	elapsed := time.Since(started)
+	if first != nil {
+		fmt.Fprintf(out, "First regression (%s) after %s and %d packages, of %s and %d in total\n",
+			first.Slug, first.After, first.Packages, elapsed, len(results))
+	} else {
+		fmt.Fprintf(out, "No regressions in %s and %d packages\n", elapsed, len(results))
+	}
+
+	diagnostics := groupDiagnostics(results)
+	if len(diagnostics) > 0 {
+		fmt.Fprintf(out, "Most widespread compiler diagnostics:\n")
+		for i, d := range diagnostics {
+			if i == 5 {
+				break
+			}
+			fmt.Fprintf(out, "\t%d packages\t%s\n", len(d.Packages), d.Message)
+		}
+	}
+
+	slowest := slowestBuilds(results, 5)
+	if len(slowest) > 0 {
+		fmt.Fprintf(out, "Largest build time regressions:\n")
+		for _, r := range slowest {
+			fmt.Fprintf(out, "\t%+.0f%%\t%s -> %s\t%s\n", buildSlowdown(r)*100,
+				r.preBuildTime, r.postBuildTime, r.name())
+		}
+	}
+
+	partial := make([]string, 0)
+	for _, r := range results {
+		for _, s := range r.patches {
+			if s.partial() {
+				partial = append(partial, fmt.Sprintf("\t%d/%d hunks rejected\t%s (%s)",
+					s.rejected, s.hunks, r.name(), s.packageName))
+				for _, h := range s.rejects {
+					partial = append(partial, "\t\t"+h.String())
+				}
+			}
+		}
+	}
+	if len(partial) > 0 {
+		fmt.Fprintf(out, "Partially applied patches:\n%s\n", strings.Join(partial, "\n"))
+	}
+
+	if args.sample > 0 {
+		rate, low, high, testable := sampledRate(results, inclusion)
+		if testable > 0 {
+			fmt.Fprintf(out, "Estimated regression rate: %.1f%% from %d testable packages (95%% CI %.1f%%-%.1f%%)\n",
+				100*rate, testable, 100*low, 100*high)
+		}
+	}
+
+	if args.deps {
+		outside := make([]string, 0)
+		for _, r := range results {
+			if r.checkedDeps && !r.inGraph {
+				outside = append(outside, r.name())
+			}
+		}
+		if len(outside) > 0 {
+			fmt.Fprintf(out, "Tested without building the patched packages:\n\t%s\n", strings.Join(outside, "\n\t"))
+		}
+
+		for _, r := range results {
+			if len(r.newDeps) > 0 {
+				fmt.Fprintf(out, "New dependencies of %s post-patch:\n\t%s\n", r.name(), strings.Join(r.newDeps, "\n\t"))
+			}
+		}
+	}
+
+	swings := largestTestDeltas(results, 5)
+	if len(swings) > 0 {
+		fmt.Fprintf(out, "Largest changes in tests run:\n")
+		for _, r := range swings {
+			fmt.Fprintf(out, "\t%+d (%d to %d)\t%s\n", r.postTests-r.preTests, r.preTests, r.postTests, r.name())
+		}
+	}
+
+	largest := largestPackages(results, 5)
+	if len(largest) > 0 {
+		fmt.Fprintf(out, "Largest packages:\n")
+		for _, r := range largest {
+			fmt.Fprintf(out, "\t%s\t%s\n", formatBytes(r.diskUsage), r.name())
+		}
+	}
+
+	if weighted {
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].importers > results[j].importers
+		})
+	}
+
+	err = writeReport(args.reportFile, args.reportFormat, args.runTag, results)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to write test report: %s\n", err.Error())
+		return summary, 1
+	}
+
+	if args.outputDir != "" {
+		err = writeSummaryJSON(path.Join(args.outputDir, "summary.json"),
+			args.runTag, len(packages), summary, first, elapsed, diagnostics)
+		if err == nil {
+			err = writeManifest(path.Join(args.outputDir, "manifest.json"),
+				&args, len(packages), started, time.Now())
+		}
+		if err != nil {
+			fmt.Fprintf(out, "Failed to write run summary: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	if args.githubChecksFile != "" || args.githubRepo != "" {
+		err = reportToGitHub(&args, results, summary)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to report to GitHub: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	if args.sqliteFile != "" {
+		err = exportSQLite(args.sqliteFile, args.runTag, started, results)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to export results to SQLite: %s\n", err.Error())
+			return summary, 1
+		}
+	}
+
+	if args.cleanCacheAfter {
+		if err := cleanCaches(&args, allPkgs); err != nil {
+			fmt.Fprintf(out, "Failed to clean up caches: %s\n", err.Error())
+		}
+	}
+
+	if unhealthy {
+		return summary, 1
+	}
+
+	return summary, runStatus(out, &args, summary)
+}
+
+// runStatus works out the exit code for a completed run from its results:
+// 2 if the patch caused regressions (or, in strict mode, warnings), and 0
+// otherwise. With --min-pass-rate, it's the pass rate that decides whether
+// the regressions fail the run.
+func runStatus(out io.Writer, args *arguments, summary map[testResult]int) int {
+	if args.minPassRate > 0 {
+		rate, testable := passRate(summary)
+		fmt.Fprintf(out, "%.1f%% of %d testable packages passed\n", rate*100, testable)
+		if rate < args.minPassRate {
+			fmt.Fprintf(out, "Pass rate is below the minimum of %.1f%%\n", args.minPassRate*100)
+			return 2
+		}
+	} else {
+		for r, count := range summary {
+			if count > 0 && isRegression(r) {
+				fmt.Fprintf(out, "Failing due to %d packages with result %q\n", count, r.Error())
+				return 2
+			}
+		}
+	}
+
+	if args.strict {
+		for r, count := range summary {
+			if count > 0 && (isWarning(r) || isStrictFailure(r)) {
+				fmt.Fprintf(out, "Strict mode: failing due to %d packages with result %q\n",
+					count, r.Error())
+				return 2
+			}
+		}
+	}
+
+	return 0
 }
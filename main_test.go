@@ -0,0 +1,55 @@
+package impact
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestRunStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    arguments
+		summary map[testResult]int
+		want    int
+	}{
+		{
+			name:    "all passed",
+			summary: map[testResult]int{passed: 10},
+			want:    0,
+		},
+		{
+			name:    "a regression",
+			summary: map[testResult]int{passed: 9, failedPostPatchTest: 1},
+			want:    2,
+		},
+		{
+			name:    "a regression within the pass rate",
+			args:    arguments{minPassRate: 0.8},
+			summary: map[testResult]int{passed: 9, failedPostPatchTest: 1},
+			want:    0,
+		},
+		{
+			name:    "regressions below the pass rate",
+			args:    arguments{minPassRate: 0.95},
+			summary: map[testResult]int{passed: 9, failedPostPatchTest: 1},
+			want:    2,
+		},
+		{
+			name:    "a warning",
+			summary: map[testResult]int{passed: 9, flakyTests: 1},
+			want:    0,
+		},
+		{
+			name:    "a warning in strict mode",
+			args:    arguments{strict: true},
+			summary: map[testResult]int{passed: 9, flakyTests: 1},
+			want:    2,
+		},
+	}
+
+	for _, test := range tests {
+		if got := runStatus(ioutil.Discard, &test.args, test.summary); got != test.want {
+			t.Errorf("%s: got exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package impact
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// availableMemory reports how many bytes of memory are available for new
+// processes, as estimated by the kernel. Only Linux is supported.
+func availableMemory() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+
+	if s.Err() != nil {
+		return 0, s.Err()
+	}
+	return 0, errors.New("MemAvailable not reported in /proc/meminfo")
+}
+
+// buildSlots works out how many packages can be built and tested at once
+// without exhausting memory, given an estimate of how much memory a single
+// build needs. It is never more than the worker count, and never less than
+// one. Any trouble finding out is reported to out.
+func buildSlots(out io.Writer, concurrency int, perBuildMB int) int {
+	if perBuildMB <= 0 {
+		return concurrency
+	}
+
+	avail, err := availableMemory()
+	if err != nil {
+		fmt.Fprintf(out, "Can't determine available memory, not throttling builds: %s\n", err.Error())
+		return concurrency
+	}
+
+	slots := int(avail / (uint64(perBuildMB) * 1024 * 1024))
+	if slots < 1 {
+		slots = 1
+	}
+	if slots > concurrency {
+		slots = concurrency
+	}
+	return slots
+}
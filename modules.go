@@ -0,0 +1,200 @@
+package impact
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The ways the go command can find packages: in a GOPATH, or as modules.
+const (
+	modeGOPATH = "gopath"
+	modeModule = "module"
+)
+
+// moduleEnv switches an environment over to module mode. GOPATH stays set
+// to the package's workdir, so that each package still gets a module cache
+// of its own. -mod=mod lets the go command fill in go.sum as modules are
+// replaced with patchable copies.
+func moduleEnv(env []string) []string {
+	env = setEnv(env, "GO111MODULE", "on")
+	flags, _ := lookupEnv(env, "GOFLAGS")
+	return setEnv(env, "GOFLAGS", strings.TrimSpace(flags+" -mod=mod"))
+}
+
+// sharedModCacheEnv points an environment at a module cache shared between
+// packages, so that each module is only downloaded once. The go command
+// locks the cache while it writes to it, so concurrent downloads are safe;
+// what isn't is a package writing into a module it shares with others,
+// which is why -modcacherw is dropped, leaving the cache read-only. In
+// module mode, modules are copied out of the cache before they're patched.
+func sharedModCacheEnv(env []string, dir string) []string {
+	env = setEnv(env, "GOMODCACHE", dir)
+	flags, ok := lookupEnv(env, "GOFLAGS")
+	if !ok {
+		return env
+	}
+
+	kept := make([]string, 0)
+	for _, f := range strings.Fields(flags) {
+		if f != "-modcacherw" {
+			kept = append(kept, f)
+		}
+	}
+	return setEnv(env, "GOFLAGS", strings.Join(kept, " "))
+}
+
+// moduleMode reports whether an environment puts the go command in module
+// mode.
+func moduleMode(env []string) bool {
+	mode, _ := lookupEnv(env, "GO111MODULE")
+	return mode == "on"
+}
+
+// srcDir is where a package's source lives in the environment's GOPATH.
+// In module mode, the modules that need to be patched or tested are copied
+// out of the module cache into the same layout, so it's the same there.
+func srcDir(env []string, slug string) string {
+	gopath, _ := lookupEnv(env, "GOPATH")
+	return path.Join(gopath, "src", slug)
+}
+
+// moduleOf finds the module that provides a package, as seen from the
+// module in dir, and where its source is.
+func moduleOf(env []string, dir, importPath string) (string, string, error) {
+	list := goCommand(env, "list", "-f", "{{with .Module}}{{.Path}}\t{{.Dir}}{{end}}", importPath)
+	list.Dir = dir
+	out, err := list.Output()
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), "\t")
+	if len(fields) != 2 || fields[1] == "" {
+		return "", "", fmt.Errorf("%s isn't provided by a module", importPath)
+	}
+	return fields[0], fields[1], nil
+}
+
+// localizeModule copies a module's source out of the module cache to dst.
+// The cache is read-only, so the copy is made writable.
+func localizeModule(modDir, dst string) error {
+	if err := copyTree(modDir, dst); err != nil {
+		return err
+	}
+
+	return filepath.Walk(dst, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return os.Chmod(file, info.Mode().Perm()|0200)
+	})
+}
+
+// fetchModule fetches the module providing a package in module mode. The
+// module is resolved in a scratch module, then copied into the workdir's
+// src, where it serves as the main module for the package's tests, and has
+// its dependencies downloaded.
+func fetchModule(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error) {
+	fmt.Fprintf(s.progress, "%04d: %d Fetching module...\n", p.index, idx)
+	// the scratch module is kept, as the record of which version was
+	// resolved
+	scratch := path.Join(dir, "fetch")
+	if err := os.Mkdir(scratch, 0755); err != nil {
+		return failedUnexpectedly, err
+	}
+
+	init := goCommand(env, "mod", "init", "impact.fetch")
+	init.Dir = scratch
+	init.Stdout = s.progress
+	init.Stderr = s.progress
+	if err := init.Run(); err != nil {
+		return failedUnexpectedly, err
+	}
+
+	query := p.slug
+	if p.version != "" {
+		query += "@" + p.version
+	}
+	get := goCommand(env, "get", query)
+	get.Dir = scratch
+	if result, err := runFetchCommand(s, idx, p, get, timeout); result != passed {
+		return result, err
+	}
+
+	modPath, modDir, err := moduleOf(env, scratch, p.slug)
+	if err != nil {
+		return fetchFailed, err
+	}
+	root := path.Join(dir, "src", modPath)
+	if err := localizeModule(modDir, root); err != nil {
+		return failedUnexpectedly, err
+	}
+
+	// modules from before go.mod only have one synthesized in the cache's
+	// metadata, so the copy needs a go.mod of its own, with its
+	// requirements worked out from its imports
+	if _, err := os.Stat(path.Join(root, "go.mod")); os.IsNotExist(err) {
+		init := goCommand(env, "mod", "init", modPath)
+		init.Dir = root
+		init.Stdout = s.progress
+		init.Stderr = s.progress
+		if err := init.Run(); err != nil {
+			return failedUnexpectedly, err
+		}
+
+		tidy := goCommand(env, "mod", "tidy")
+		tidy.Dir = root
+		return runFetchCommand(s, idx, p, tidy, timeout)
+	}
+
+	download := goCommand(env, "mod", "download")
+	download.Dir = root
+	return runFetchCommand(s, idx, p, download, timeout)
+}
+
+// fetchDeps fetches the dependencies of a package whose own source is
+// already in place.
+func fetchDeps(s *session, idx int, p pkg, dir string, timeout time.Duration, env []string) (testResult, error) {
+	if moduleMode(env) {
+		download := goCommand(env, "mod", "download")
+		download.Dir = path.Join(dir, "src", p.slug)
+		return runFetchCommand(s, idx, p, download, timeout)
+	}
+
+	// with the package itself in place, go get only fetches what's missing
+	return fetchCode(s, idx, p, dir, timeout, env)
+}
+
+// localizeTargets makes the patch targets that the package gets from the
+// module cache patchable, by copying their modules into the workdir's src
+// and replacing the originals with the copies. Targets the package doesn't
+// depend on are left alone, and so won't be found to patch.
+func localizeTargets(s *session, idx int, p pkg, targets []target, dir string, env []string) error {
+	pkgDir := path.Join(dir, "src", p.slug)
+	local := path.Join(dir, "src") + "/"
+	for _, t := range targets {
+		modPath, modDir, err := moduleOf(env, pkgDir, t.packageName)
+		if err != nil || strings.HasPrefix(modDir+"/", local) {
+			continue
+		}
+
+		fmt.Fprintf(s.progress, "%04d: %d Copying %s out of the module cache\n", p.index, idx, modPath)
+		copied := path.Join(dir, "src", modPath)
+		if err := localizeModule(modDir, copied); err != nil {
+			return err
+		}
+
+		edit := goCommand(env, "mod", "edit", fmt.Sprintf("-replace=%s=%s", modPath, copied))
+		edit.Dir = pkgDir
+		edit.Stdout = s.progress
+		edit.Stderr = s.progress
+		if err := edit.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package impact
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// prepareOutputDir creates the directory layout used by --output-dir:
+//
+//	<dir>/report.txt     the report
+//	<dir>/summary.json   counts of each result
+//	<dir>/manifest.json  what was run, and when
+//	<dir>/logs/          per-package test logs
+//	<dir>/artifacts/     per-package workdirs
+func prepareOutputDir(dir string) error {
+	for _, d := range []string{dir, path.Join(dir, "logs"), path.Join(dir, "artifacts")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritable makes sure that an output file can be written before the
+// run starts, rather than discovering that it can't once the run is over.
+// The file itself isn't created or modified.
+func checkWritable(filename string) error {
+	info, err := os.Stat(filename)
+	switch {
+	case err == nil && info.IsDir():
+		return fmt.Errorf("%s is a directory", filename)
+
+	case err == nil:
+		file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	dir := path.Dir(filename)
+	info, err = os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("The directory %s does not exist", dir)
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	probe, err := ioutil.TempFile(dir, ".impact-probe-")
+	if err != nil {
+		return fmt.Errorf("Can't write to %s: %s", dir, err.Error())
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+type summaryEntry struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Count       int    `json:"count"`
+}
+
+// firstRegression records how long, and how many packages, it took for the
+// first regression to show up.
+type firstRegression struct {
+	After    time.Duration `json:"after_ns"`
+	Packages int           `json:"packages"`
+	Slug     string        `json:"slug"`
+}
+
+type summaryDoc struct {
+	Run             string            `json:"run"`
+	Packages        int               `json:"packages"`
+	Tested          int               `json:"tested"`
+	Elapsed         time.Duration     `json:"elapsed_ns"`
+	FirstRegression *firstRegression  `json:"first_regression"`
+	Results         []summaryEntry    `json:"results"`
+	Diagnostics     []diagnosticGroup `json:"diagnostics"`
+}
+
+func writeSummaryJSON(filename, runTag string, packages int, summary map[testResult]int,
+	first *firstRegression, elapsed time.Duration, diagnostics []diagnosticGroup) error {
+	doc := summaryDoc{
+		Run:             runTag,
+		Packages:        packages,
+		Elapsed:         elapsed,
+		FirstRegression: first,
+		Results:         make([]summaryEntry, 0),
+		Diagnostics:     diagnostics,
+	}
+	for r, count := range summary {
+		doc.Tested += count
+		doc.Results = append(doc.Results, summaryEntry{
+			Code:        resultCode(r),
+			Description: r.Error(),
+			Count:       count,
+		})
+	}
+	sort.Slice(doc.Results, func(i, j int) bool {
+		return doc.Results[i].Code < doc.Results[j].Code
+	})
+
+	return writeJSON(filename, doc)
+}
+
+type manifestTarget struct {
+	Package   string `json:"package"`
+	PatchFile string `json:"patch_file"`
+}
+
+type manifestDoc struct {
+	Run         string           `json:"run"`
+	Targets     []manifestTarget `json:"targets"`
+	PackageList string           `json:"package_list"`
+	Packages    int              `json:"packages"`
+	Concurrency int              `json:"concurrency"`
+	Started     time.Time        `json:"started"`
+	Finished    time.Time        `json:"finished"`
+}
+
+func writeManifest(filename string, args *arguments, packages int, started, finished time.Time) error {
+	targets := make([]manifestTarget, 0, len(args.targets))
+	for _, t := range args.targets {
+		targets = append(targets, manifestTarget{Package: t.packageName, PatchFile: t.patchFile})
+	}
+
+	return writeJSON(filename, manifestDoc{
+		Run:         args.runTag,
+		Targets:     targets,
+		PackageList: args.packageListFile,
+		Packages:    packages,
+		Concurrency: args.concurrency,
+		Started:     started,
+		Finished:    finished,
+	})
+}
+
+func writeJSON(filename string, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(bytes, '\n'), 0644)
+}
@@ -0,0 +1,50 @@
+package impact
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadPatchMap reads a file mapping packages to the patches to test them
+// with, one "slug patchfile" pair per line. Relative patch paths are taken
+// to be relative to the map file itself.
+func loadPatchMap(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	patches := make(map[string]string)
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"slug patchfile\"", filename, n)
+		}
+
+		patchFile := fields[1]
+		if !filepath.IsAbs(patchFile) {
+			patchFile = filepath.Join(filepath.Dir(filename), patchFile)
+		}
+		patches[fields[0]] = patchFile
+	}
+	return patches, s.Err()
+}
+
+// targetsFor picks the patches to apply to a package: its own patch from
+// the patch map, if it has one, or the --delta patches otherwise.
+func (args *arguments) targetsFor(p pkg) []target {
+	if patchFile, ok := args.patchMap[p.slug]; ok {
+		return []target{{packageName: args.targets[0].packageName, patchFile: patchFile, named: true}}
+	}
+	return args.targets
+}
@@ -0,0 +1,161 @@
+package impact
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// popularity maps a package slug onto the number of packages known to
+// import it.
+type popularity map[string]int
+
+// loadPopularityCache reads a previously saved set of importer counts. A
+// missing cache file is not an error; it just means nothing is cached yet.
+func loadPopularityCache(filename string) (popularity, error) {
+	result := make(popularity)
+	if filename == "" {
+		return result, nil
+	}
+
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, &result)
+	return result, err
+}
+
+func savePopularityCache(filename string, counts popularity) error {
+	bytes, err := json.MarshalIndent(counts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, bytes, 0644)
+}
+
+// queryImporters asks the popularity endpoint how many packages import the
+// given slug. The endpoint URL is built by substituting the slug for
+// "{slug}" in the template, and the response body may either be a bare
+// integer or a JSON object with a "count" field.
+func queryImporters(client *http.Client, urlTemplate, slug string) (int, error) {
+	url := strings.Replace(urlTemplate, "{slug}", slug, -1)
+	rsp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Popularity lookup for %s returned %s", slug, rsp.Status)
+	}
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	text := strings.TrimSpace(string(body))
+	if n, err := strconv.Atoi(text); err == nil {
+		return n, nil
+	}
+
+	var doc struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return 0, fmt.Errorf("Unrecognised popularity response for %s", slug)
+	}
+	return doc.Count, nil
+}
+
+// lookupPopularity fills in the importer counts for the supplied packages,
+// using the cache where it can and the endpoint where it can't. A package
+// whose lookup fails is warned about on out and left unweighted, and the
+// rest are still cached and weighted. Only if no package could be weighted
+// does lookupPopularity return an error; callers should then carry on
+// without weighting.
+func lookupPopularity(out io.Writer, pkgs []pkg, args *arguments) error {
+	counts, err := loadPopularityCache(args.popularityCache)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var mutex sync.Mutex
+	var failure error
+	pending := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < args.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				n, err := queryImporters(client, args.popularityURL, pkgs[i].slug)
+
+				mutex.Lock()
+				if err != nil {
+					fmt.Fprintf(out, "Popularity lookup failed, not weighting %s: %s\n", pkgs[i].slug, err.Error())
+					if failure == nil {
+						failure = err
+					}
+				} else {
+					counts[pkgs[i].slug] = n
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for i, p := range pkgs {
+		mutex.Lock()
+		_, cached := counts[p.slug]
+		mutex.Unlock()
+		if cached {
+			continue
+		}
+		pending <- i
+	}
+	close(pending)
+	wg.Wait()
+
+	weighted := 0
+	for i := range pkgs {
+		n, ok := counts[pkgs[i].slug]
+		if ok {
+			weighted++
+		}
+		pkgs[i].importers = n
+	}
+	if failure != nil && weighted == 0 {
+		return failure
+	}
+
+	if args.popularityCache != "" {
+		return savePopularityCache(args.popularityCache, counts)
+	}
+
+	return nil
+}
+
+// byPopularity orders packages so that the most widely imported come first,
+// preserving the package list order between equally popular packages.
+func byPopularity(pkgs []pkg) {
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].importers > pkgs[j].importers
+	})
+}
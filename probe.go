@@ -0,0 +1,136 @@
+package impact
+
+import (
+	"fmt"
+	pflag "github.com/ogier/pflag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// minFreeDisk is the least free space in the work root that probe will
+// accept. Each package checks out its whole dependency tree, so even a
+// modest run needs a good deal of space.
+const minFreeDisk = 5 << 30
+
+// probeCheck is a single check of the environment a run depends on.
+type probeCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// probe checks that the environment is fit for a run, printing a PASS or
+// FAIL for each check, and returns the process exit code.
+func probe(argv []string) int {
+	var goRoot, outputDir string
+	flags := pflag.NewFlagSet("Impact probe", pflag.ContinueOnError)
+	flags.StringVar(&goRoot, "go", "",
+		"The root of the Go toolchain to check, as for a run")
+	flags.StringVar(&outputDir, "output-dir", "",
+		"The output directory to check, as for a run")
+	if err := flags.Parse(argv); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	env := getEnv()
+	if goRoot != "" {
+		env = useToolchain(env, goRoot)
+	}
+
+	workRoot := "."
+	if outputDir != "" {
+		workRoot = path.Join(outputDir, "artifacts")
+	}
+
+	checks := []probeCheck{
+		{"go toolchain", func() (string, error) { return goVersion(env) }},
+		{"patch", func() (string, error) { return exec.LookPath("patch") }},
+		{"git", func() (string, error) { return exec.LookPath("git") }},
+		{"module proxy", func() (string, error) { return probeProxy(env) }},
+		{"work root writable", func() (string, error) { return probeWritable(workRoot) }},
+		{"free disk", func() (string, error) { return probeDisk(workRoot) }},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		detail, err := c.run()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s: %s\n", c.name, err.Error())
+			continue
+		}
+		fmt.Printf("PASS\t%s: %s\n", c.name, detail)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	return 0
+}
+
+func goVersion(env []string) (string, error) {
+	out, err := goCommand(env, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// probeProxy checks that the first module proxy the toolchain would use
+// can be reached.
+func probeProxy(env []string) (string, error) {
+	out, err := goCommand(env, "env", "GOPROXY").Output()
+	if err != nil {
+		return "", err
+	}
+
+	for _, proxy := range strings.FieldsFunc(strings.TrimSpace(string(out)), func(r rune) bool {
+		return r == ',' || r == '|'
+	}) {
+		if proxy == "direct" || proxy == "off" {
+			continue
+		}
+
+		client := http.Client{Timeout: 10 * time.Second}
+		rsp, err := client.Get(proxy)
+		if err != nil {
+			return "", err
+		}
+		rsp.Body.Close()
+		return fmt.Sprintf("%s (%s)", proxy, rsp.Status), nil
+	}
+	return "no proxy configured, fetching direct", nil
+}
+
+func probeWritable(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	return dir, os.Remove(file.Name())
+}
+
+func probeDisk(dir string) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return "", err
+	}
+
+	free := int64(fs.Bavail) * int64(fs.Bsize)
+	if free < minFreeDisk {
+		return "", fmt.Errorf("only %s free in %s, want at least %s",
+			formatBytes(free), dir, formatBytes(minFreeDisk))
+	}
+	return fmt.Sprintf("%s free in %s", formatBytes(free), dir), nil
+}
@@ -0,0 +1,81 @@
+package impact
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	logFormatVerbose = "verbose"
+	logFormatCompact = "compact"
+
+	// logFormatJSON streams the event log to stdout in place of the
+	// commentary, for tools to render
+	logFormatJSON = "json"
+)
+
+// console is where a run's commentary goes. With --log-format json, stdout
+// is kept for the event stream, and the commentary goes to stderr instead.
+func (args *arguments) console() io.Writer {
+	if args.logFormat == logFormatJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// compactLabel is how a result is shown in the compact log format.
+func compactLabel(r testResult) string {
+	switch {
+	case r == passed:
+		return "PASS"
+
+	case r == failedPostPatchTest:
+		return "FAIL-POST"
+
+	case r == failedPrePatchTest:
+		return "FAIL-PRE"
+
+	case r == fetchFailed, r == fetchTimedOut, r == fetchUnsupported:
+		return "FAIL-FETCH"
+
+	case r == patchFailed:
+		return "FAIL-PATCH"
+
+	case r == patchNotApplicable:
+		return "N/A"
+
+	case r == noTests:
+		return "NT"
+
+	case isSkip(r):
+		return "SKIP"
+
+	case isRegression(r):
+		return "FAIL-" + resultCode(r)
+
+	case isWarning(r):
+		return "WARN-" + resultCode(r)
+
+	default:
+		return "ERROR"
+	}
+}
+
+// compactLine summarises a package's check in a single line, for the
+// compact log format, optionally with the result in colour.
+func compactLine(r reply, color bool) string {
+	label := compactLabel(r.result)
+	if color {
+		label = colorize(r.result, label)
+	}
+	line := fmt.Sprintf("[%s] %s (%.1fs)", label, r.name(), r.duration.Seconds())
+	switch {
+	case r.result == failedPostPatchTest && len(r.failures) > 0:
+		line += fmt.Sprintf(": %d tests", len(r.failedTests()))
+
+	case r.err_ != nil:
+		line += ": " + r.err_.Error()
+	}
+	return line
+}
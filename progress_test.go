@@ -0,0 +1,33 @@
+package impact
+
+import (
+	"testing"
+)
+
+func TestCompactLabel(t *testing.T) {
+	tests := []struct {
+		result testResult
+		want   string
+	}{
+		{passed, "PASS"},
+		{failedPostPatchTest, "FAIL-POST"},
+		{failedPrePatchTest, "FAIL-PRE"},
+		{fetchFailed, "FAIL-FETCH"},
+		{patchFailed, "FAIL-PATCH"},
+		{patchNotApplicable, "N/A"},
+		{skippedTooSlow, "SKIP"},
+		{noTests, "NT"},
+		{notExternal, "SKIP"},
+		{notInGraph, "SKIP"},
+		{skippedOutOfTime, "SKIP"},
+		{skippedFailFast, "SKIP"},
+		{flakyTests, "WARN-WF"},
+		{failedUnexpectedly, "ERROR"},
+	}
+
+	for _, test := range tests {
+		if got := compactLabel(test.result); got != test.want {
+			t.Errorf("%s: got %q, want %q", resultCode(test.result), got, test.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package impact
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+)
+
+// How the results of the sub-packages of a --recursive test are rolled up
+// into a result for the package.
+const (
+	// the package fails if any of its sub-packages do
+	aggregateAnyFail = "any-fail"
+
+	// only the package's own result counts
+	aggregateRootOnly = "root-only"
+
+	// each sub-package is reported as a package in its own right
+	aggregateReportAll = "report-all"
+)
+
+// the outcome lines `go test` prints for each package, as opposed to each
+// test, e.g. "ok  \texample.com/a\t0.01s"
+var packageOutcome = regexp.MustCompile(`^(ok|FAIL|\?)\s+(\S+)`)
+
+const (
+	outcomePassed  = "ok"
+	outcomeFailed  = "FAIL"
+	outcomeNoTests = "?"
+)
+
+// testPattern is the package pattern to test a package with.
+func (p pkg) testPattern() string {
+	if p.recursive {
+		return p.slug + "/..."
+	}
+	return p.slug
+}
+
+// packageOutcomes reads the outcome of each package tested from a test log.
+func packageOutcomes(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	outcomes := make(map[string]string)
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		if m := packageOutcome.FindStringSubmatch(s.Text()); m != nil {
+			outcomes[m[2]] = m[1]
+		}
+	}
+	return outcomes, s.Err()
+}
+
+// aggregate decides whether a recursive test run that failed with err
+// passed under the aggregation policy, returning nil if it did. For the
+// baseline, report-all only needs one sub-package to pass for there to be
+// something worth patching; post-patch, the failures are sorted out by
+// splitRecursive instead.
+func (args *arguments) aggregate(p pkg, logfile string, err error, baseline bool) error {
+	if err == nil || !p.recursive || args.aggregation == aggregateAnyFail {
+		return err
+	}
+
+	outcomes, logErr := packageOutcomes(logfile)
+	if logErr != nil {
+		return logErr
+	}
+
+	switch args.aggregation {
+	case aggregateRootOnly:
+		if outcomes[p.slug] != outcomeFailed {
+			return nil
+		}
+
+	case aggregateReportAll:
+		if !baseline {
+			break
+		}
+		for _, o := range outcomes {
+			if o == outcomePassed {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// splitRecursive turns the reply for a recursively tested package into a
+// reply for each sub-package, for the report-all policy. Sub-packages with
+// no tests are reported as such. Packages that never got as far as testing
+// have nothing to split.
+func splitRecursive(rpy reply) []reply {
+	switch rpy.result {
+	case passed, failedPrePatchTest, failedPostPatchTest:
+	default:
+		return []reply{rpy}
+	}
+
+	pre, err := packageOutcomes(path.Join(rpy.logDir, "pre-test.log"))
+	if err != nil {
+		return []reply{rpy}
+	}
+	post, err := packageOutcomes(path.Join(rpy.logDir, "post-test.log"))
+	if err != nil && !os.IsNotExist(err) {
+		return []reply{rpy}
+	}
+
+	names := make([]string, 0, len(pre))
+	for name := range pre {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return []reply{rpy}
+	}
+	sort.Strings(names)
+
+	result := make([]reply, 0, len(names))
+	for _, name := range names {
+		sub := rpy
+		sub.slug = name
+		sub.listed = rpy.name()
+		sub.result = passed
+		switch {
+		case pre[name] == outcomeFailed:
+			sub.result = failedPrePatchTest
+
+		case post[name] == outcomeFailed:
+			sub.result = failedPostPatchTest
+
+		case pre[name] == outcomeNoTests:
+			sub.result = noTests
+
+		case post[name] == "":
+			// never tested post-patch, as every sub-package failed the
+			// baseline or the patch failed the whole package
+			sub.result = rpy.result
+		}
+		result = append(result, sub)
+	}
+	return result
+}
+
+// reportRows gives the rows a reply makes in the report: just the one,
+// unless it's to be split up into its sub-packages.
+func (args *arguments) reportRows(rpy reply) []reply {
+	if rpy.recursive && args.aggregation == aggregateReportAll {
+		return splitRecursive(rpy)
+	}
+	return []reply{rpy}
+}
+
+// validAggregation checks an aggregation policy from the command line.
+func validAggregation(policy string) error {
+	switch policy {
+	case aggregateAnyFail, aggregateRootOnly, aggregateReportAll:
+		return nil
+	}
+	return fmt.Errorf("Unknown aggregation policy %q; expected %s, %s or %s",
+		policy, aggregateAnyFail, aggregateRootOnly, aggregateReportAll)
+}
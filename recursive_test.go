@@ -0,0 +1,34 @@
+package impact
+
+import (
+	"testing"
+)
+
+func TestSplitRecursive(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"pre-test.log": "ok  \texample.com/a\t0.01s\n" +
+			"?   \texample.com/a/cmd\t[no test files]\n" +
+			"ok  \texample.com/a/b\t0.01s\n",
+		"post-test.log": "ok  \texample.com/a\t0.01s\n" +
+			"?   \texample.com/a/cmd\t[no test files]\n" +
+			"FAIL\texample.com/a/b\t0.01s\n",
+	})
+
+	rpy := reply{pkg: pkg{slug: "example.com/a", recursive: true}, result: failedPostPatchTest, logDir: dir}
+	want := map[string]testResult{
+		"example.com/a":     passed,
+		"example.com/a/b":   failedPostPatchTest,
+		"example.com/a/cmd": noTests,
+	}
+
+	rows := splitRecursive(rpy)
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for _, row := range rows {
+		if row.result != want[row.slug] {
+			t.Errorf("%s: got %s, want %s", row.slug, resultCode(row.result), resultCode(want[row.slug]))
+		}
+	}
+}
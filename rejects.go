@@ -0,0 +1,119 @@
+package impact
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rejectedHunk identifies a hunk that failed to apply, by the file it was
+// for and its header, which gives the lines it covers.
+type rejectedHunk struct {
+	File   string `json:"file"`
+	Header string `json:"header"`
+}
+
+func (h rejectedHunk) String() string {
+	return h.File + " " + h.Header
+}
+
+// countHunks counts the hunks in a unified diff.
+func countHunks(diffFile string) (int, error) {
+	file, err := os.Open(diffFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	hunks := 0
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "@@ ") {
+			hunks++
+		}
+	}
+	return hunks, s.Err()
+}
+
+// rejectFiles finds the .rej files that patch(1) leaves behind for each
+// file it couldn't completely patch.
+func rejectFiles(dir string) ([]string, error) {
+	rejects := make([]string, 0)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(file, ".rej") {
+			rejects = append(rejects, file)
+		}
+		return nil
+	})
+	return rejects, err
+}
+
+// countRejectedHunks totals the hunks in all of the reject files under dir.
+func countRejectedHunks(dir string) (int, error) {
+	rejects, err := rejectFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, r := range rejects {
+		n, err := countHunks(r)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// rejectedHunks lists the hunks in all of the reject files under dir, with
+// the files they were for given relative to dir.
+func rejectedHunks(dir string) ([]rejectedHunk, error) {
+	rejects, err := rejectFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hunks := make([]rejectedHunk, 0)
+	for _, r := range rejects {
+		target, err := filepath.Rel(dir, strings.TrimSuffix(r, ".rej"))
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := os.Open(r)
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(file)
+		for s.Scan() {
+			line := s.Text()
+			if !strings.HasPrefix(line, "@@ ") {
+				continue
+			}
+			// drop the function context that may follow the line ranges
+			if end := strings.Index(line[3:], " @@"); end >= 0 {
+				line = line[:end+6]
+			}
+			hunks = append(hunks, rejectedHunk{File: target, Header: line})
+		}
+		file.Close()
+		if s.Err() != nil {
+			return nil, s.Err()
+		}
+	}
+	return hunks, nil
+}
+
+// rejectedHunks gathers the hunks rejected from all of the reply's patches.
+func (rpy reply) rejectedHunks() []rejectedHunk {
+	hunks := make([]rejectedHunk, 0)
+	for _, s := range rpy.patches {
+		hunks = append(hunks, s.rejects...)
+	}
+	return hunks
+}
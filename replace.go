@@ -0,0 +1,73 @@
+package impact
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// errNotInGraph means that a package doesn't depend on the module being
+// replaced, directly or otherwise.
+var errNotInGraph = errors.New("Replaced module not in the package's dependency graph")
+
+// moduleReplace is a replace directive to build packages with in place of
+// a patch, pointing a module at a ref of some other repository.
+type moduleReplace struct {
+	module string
+	repo   string
+	ref    string
+}
+
+// parseReplace parses a replacement of the form "module=repo@ref".
+func parseReplace(s string) (*moduleReplace, error) {
+	eq := strings.Index(s, "=")
+	at := strings.LastIndex(s, "@")
+	if eq <= 0 || at <= eq+1 || at == len(s)-1 {
+		return nil, fmt.Errorf("Invalid --replace-with %q; expected module=repo@ref", s)
+	}
+	return &moduleReplace{module: s[:eq], repo: s[eq+1 : at], ref: s[at+1:]}, nil
+}
+
+func (r *moduleReplace) String() string {
+	return fmt.Sprintf("%s=>%s@%s", r.module, r.repo, r.ref)
+}
+
+// applyReplace adds the replace directive to the package's go.mod and
+// checks that the replacement resolves. Replace directives only take
+// effect in the main module, which is what makes this work for modules the
+// package depends on indirectly: the package's own go.mod overrides the
+// version its dependencies ask for. Packages without a go.mod can't take a
+// replace directive, so it's not applicable to them, and packages that
+// don't depend on the module at all are not in its graph.
+func applyReplace(s *session, idx int, p pkg, r *moduleReplace, dir string, env []string) error {
+	modDir := path.Join(dir, "src", p.slug)
+	if _, err := os.Stat(path.Join(modDir, "go.mod")); os.IsNotExist(err) {
+		return errPatchNotApplicable
+	}
+
+	list := goCommand(env, "list", "-m", r.module)
+	list.Dir = modDir
+	if list.Run() != nil {
+		return errNotInGraph
+	}
+
+	fmt.Fprintf(s.progress, "%04d: %d Replacing %s\n", p.index, idx, r)
+	edit := goCommand(env, "mod", "edit", fmt.Sprintf("-replace=%s=%s@%s", r.module, r.repo, r.ref))
+	edit.Dir = modDir
+	edit.Stdout = s.progress
+	edit.Stderr = s.progress
+	if err := edit.Run(); err != nil {
+		return err
+	}
+
+	// resolving the module again fetches the replacement, and fails if the
+	// ref doesn't exist. It also records the replacement in go.sum, so
+	// that the tests can build with it.
+	resolve := goCommand(env, "list", "-mod=mod", "-m", r.module)
+	resolve.Dir = modDir
+	resolve.Stdout = s.progress
+	resolve.Stderr = s.progress
+	return resolve.Run()
+}
@@ -0,0 +1,426 @@
+package impact
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	pflag "github.com/ogier/pflag"
+	"html/template"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportRow is a single package's line in the report.
+type reportRow struct {
+	Index     int
+	Code      string
+	Name      string
+	DiskUsage int64
+	Patches   string
+	TestDelta string
+	Failed    string
+	Timings   string
+	Error     string
+}
+
+// report is everything in a report file: the notes about the run as a
+// whole, then a row for each package.
+type report struct {
+	Notes []string
+	Rows  []reportRow
+}
+
+func buildReport(runTag string, results []reply) report {
+	var r report
+	r.Notes = append(r.Notes, fmt.Sprintf("run: %s", runTag))
+	for _, rpy := range results {
+		if rpy.shuffleSeed != 0 {
+			r.Notes = append(r.Notes, fmt.Sprintf("shuffle seed: %d", rpy.shuffleSeed))
+			break
+		}
+	}
+	for _, rpy := range results {
+		if rpy.resolvedVersion != "" {
+			r.Notes = append(r.Notes, fmt.Sprintf("version %s: %s", rpy.name(), rpy.resolvedVersion))
+		}
+	}
+	for _, c := range mergeAPIChanges(results) {
+		if c.empty() {
+			r.Notes = append(r.Notes, fmt.Sprintf("api %s: unchanged", c.packageName))
+			continue
+		}
+
+		r.Notes = append(r.Notes, fmt.Sprintf("api %s: %d added, %d removed, %d changed",
+			c.packageName, len(c.added), len(c.removed), len(c.changed)))
+		for _, n := range c.removed {
+			r.Notes = append(r.Notes, "  - "+n)
+		}
+		for _, n := range c.changed {
+			r.Notes = append(r.Notes, "  ~ "+n)
+		}
+		for _, n := range c.added {
+			r.Notes = append(r.Notes, "  + "+n)
+		}
+	}
+
+	for _, rpy := range results {
+		patches := make([]string, 0, len(rpy.patches))
+		for _, s := range rpy.patches {
+			patches = append(patches, s.String())
+		}
+
+		row := reportRow{
+			Index:     rpy.index,
+			Code:      resultCode(rpy.result),
+			Name:      rpy.name(),
+			DiskUsage: rpy.diskUsage,
+			Patches:   strings.Join(patches, ";"),
+			Failed:    strings.Join(rpy.failedTests(), ";"),
+			Timings:   rpy.timings(),
+		}
+		if rpy.testsCounted {
+			row.TestDelta = fmt.Sprintf("%+d", rpy.postTests-rpy.preTests)
+		}
+		if rpy.err_ != nil {
+			row.Error = rpy.err_.Error()
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	return r
+}
+
+// timings lists how long each of the package's phases took, for the
+// report, leaving out the phases it never reached.
+func (rpy reply) timings() string {
+	phases := []struct {
+		name string
+		time time.Duration
+	}{
+		{"fetch", rpy.fetchTime},
+		{"pre", rpy.preTestTime},
+		{"post", rpy.postTestTime},
+	}
+
+	timings := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		if phase.time > 0 {
+			timings = append(timings, fmt.Sprintf("%s=%s", phase.name, phase.time.Round(time.Millisecond)))
+		}
+	}
+	return strings.Join(timings, ";")
+}
+
+// The formats a run can write its report in.
+const (
+	reportFormatText  = "text"
+	reportFormatJSON  = "json"
+	reportFormatJUnit = "junit"
+)
+
+// ReportRecord is a package's entry in a JSON report. Its fields are part
+// of the report format, so should only ever be added to.
+type ReportRecord struct {
+	Index  int    `json:"index"`
+	Slug   string `json:"slug"`
+	Pinned string `json:"pinned,omitempty"`
+	Code   string `json:"code"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+
+	FailedTests     []string `json:"failed_tests,omitempty"`
+	ResolvedVersion string   `json:"resolved_version,omitempty"`
+
+	// how each of the child processes run for the package exited, in the
+	// order they ran
+	Exits []ExitStatus `json:"exits,omitempty"`
+
+	FetchTime    time.Duration `json:"fetch_ns,omitempty"`
+	PreTestTime  time.Duration `json:"pre_test_ns,omitempty"`
+	PostTestTime time.Duration `json:"post_test_ns,omitempty"`
+}
+
+func writeReport(filename, format, runTag string, results []reply) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case reportFormatJSON:
+		return writeJSONReport(file, results)
+
+	case reportFormatJUnit:
+		return writeJUnitReport(file, runTag, results)
+
+	default:
+		return buildReport(runTag, results).writeText(file)
+	}
+}
+
+func writeJSONReport(w io.Writer, results []reply) error {
+	records := make([]ReportRecord, 0, len(results))
+	for _, rpy := range results {
+		record := ReportRecord{
+			Index:  rpy.index,
+			Slug:   rpy.slug,
+			Pinned: rpy.version,
+			Code:   resultCode(rpy.result),
+			Result: rpy.result.Error(),
+
+			FailedTests:     rpy.failedTests(),
+			ResolvedVersion: rpy.resolvedVersion,
+			Exits:           rpy.exits,
+
+			FetchTime:    rpy.fetchTime,
+			PreTestTime:  rpy.preTestTime,
+			PostTestTime: rpy.postTestTime,
+		}
+		if rpy.err_ != nil {
+			record.Error = rpy.err_.Error()
+		}
+		records = append(records, record)
+	}
+
+	bytes, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+func (r report) writeText(w io.Writer) error {
+	for _, note := range r.Notes {
+		fmt.Fprintf(w, "# %s\n", note)
+	}
+
+	// the patch statuses and the error are free text, so they're quoted,
+	// to keep any commas or newlines in them from breaking up the row
+	for _, row := range r.Rows {
+		_, err := fmt.Fprintf(w, "%04d, %s, %s, %d, %s, %s, %s, %s, %s\n", row.Index, row.Code, row.Name,
+			row.DiskUsage, quoteField(row.Patches), row.TestDelta, row.Failed, row.Timings, quoteField(row.Error))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteField quotes a free-text report field, unless it's empty.
+func quoteField(s string) string {
+	if s == "" {
+		return ""
+	}
+	return strconv.Quote(s)
+}
+
+// splitReportRow splits a report row into its fields, unquoting those that
+// are quoted.
+func splitReportRow(line string) ([]string, error) {
+	fields := make([]string, 0, 9)
+	for {
+		var field string
+		if strings.HasPrefix(line, `"`) {
+			end := 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, errors.New("unterminated quoted field")
+			}
+
+			var err error
+			field, err = strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			line = line[end+1:]
+		} else if i := strings.Index(line, ", "); i >= 0 {
+			field, line = line[:i], line[i:]
+		} else {
+			field, line = line, ""
+		}
+		fields = append(fields, field)
+
+		if line == "" {
+			return fields, nil
+		}
+		if !strings.HasPrefix(line, ", ") {
+			return nil, errors.New("expected a comma after a quoted field")
+		}
+		line = line[2:]
+	}
+}
+
+// Description gives the meaning of a row's result code.
+func (row reportRow) Description() string {
+	r, err := parseResultCode(row.Code)
+	if err != nil {
+		return row.Code
+	}
+	return r.Error()
+}
+
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Impact report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<pre>{{range .Notes}}{{.}}
+{{end}}</pre>
+<table>
+<tr><th>#</th><th>Result</th><th>Package</th><th>Disk usage</th><th>Patches</th><th>Test delta</th><th>Failed tests</th><th>Phase times</th><th>Error</th></tr>
+{{range .Rows}}<tr><td>{{.Index}}</td><td title="{{.Description}}">{{.Code}}</td><td>{{.Name}}</td><td>{{.DiskUsage}}</td><td>{{.Patches}}</td><td>{{.TestDelta}}</td><td>{{.Failed}}</td><td>{{.Timings}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (r report) writeHTML(w io.Writer) error {
+	return htmlReport.Execute(w, r)
+}
+
+// parseReport reads back a report written by writeReport.
+func parseReport(filename string) (report, error) {
+	var r report
+	file, err := os.Open(filename)
+	if err != nil {
+		return r, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if strings.HasPrefix(line, "# ") {
+			r.Notes = append(r.Notes, strings.TrimPrefix(line, "# "))
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields, splitErr := splitReportRow(line)
+		if splitErr != nil || len(fields) != 9 {
+			fields = splitOldReportRow(line)
+		}
+		if len(fields) != 9 {
+			return r, fmt.Errorf("%s:%d: expected 9 fields", filename, n)
+		}
+
+		var row reportRow
+		row.Index, err = strconv.Atoi(fields[0])
+		if err != nil {
+			return r, fmt.Errorf("%s:%d: bad index: %s", filename, n, err.Error())
+		}
+		if _, err := parseResultCode(fields[1]); err != nil {
+			return r, fmt.Errorf("%s:%d: %s", filename, n, err.Error())
+		}
+		row.Code = fields[1]
+		row.Name = fields[2]
+		row.DiskUsage, err = strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("%s:%d: bad disk usage: %s", filename, n, err.Error())
+		}
+		row.Patches = fields[4]
+		row.TestDelta = fields[5]
+		row.Failed = fields[6]
+		row.Timings = fields[7]
+		row.Error = fields[8]
+		r.Rows = append(r.Rows, row)
+	}
+	return r, s.Err()
+}
+
+// splitOldReportRow splits a row from a report written before its free-text
+// fields were quoted. The error comes last and may itself contain commas.
+// Reports from before failed tests were listed, or before phase times were,
+// have fields missing, but their errors are in quotes, which neither a list
+// of tests nor the phase times ever are.
+func splitOldReportRow(line string) []string {
+	fields := strings.SplitN(line, ", ", 9)
+	switch {
+	case len(fields) == 7 || (len(fields) >= 8 && strings.HasPrefix(fields[6], `"`)):
+		old := strings.SplitN(line, ", ", 7)
+		fields = append(old[:6:6], "", "", old[6])
+
+	case len(fields) == 8 || (len(fields) == 9 && strings.HasPrefix(fields[7], `"`)):
+		old := strings.SplitN(line, ", ", 8)
+		fields = append(old[:7:7], "", old[7])
+	}
+	if len(fields) == 9 {
+		fields[8] = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(fields[8]), `"`), `"`)
+	}
+	return fields
+}
+
+// renderCommand rewrites an existing report in another format, and returns the
+// process exit code.
+func renderCommand(argv []string) int {
+	var in, out, format string
+	flags := pflag.NewFlagSet("Impact render", pflag.ContinueOnError)
+	flags.StringVar(&in, "in", "report.txt", "The report to render")
+	flags.StringVar(&out, "out", "", "The file to render it to. Defaults to stdout.")
+	flags.StringVar(&format, "format", "html", "The format to render it in: text or html")
+	if err := flags.Parse(argv); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	// a text report doesn't keep everything the JSON and JUnit reports
+	// carry, so those can only be written by the run itself
+	switch format {
+	case "text", "html":
+
+	case reportFormatJSON, reportFormatJUnit:
+		fmt.Printf("Rendering to %s is unsupported; use --report-format=%s on the run instead\n", format, format)
+		return 1
+
+	default:
+		fmt.Printf("Unknown format %q; expected text or html\n", format)
+		return 1
+	}
+
+	r, err := parseReport(in)
+	if err != nil {
+		fmt.Printf("Failed to read report: %s\n", err.Error())
+		return 1
+	}
+
+	w := io.Writer(os.Stdout)
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			fmt.Printf("Failed to create %s: %s\n", out, err.Error())
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if format == "text" {
+		err = r.writeText(w)
+	} else {
+		err = r.writeHTML(w)
+	}
+	if err != nil {
+		fmt.Printf("Failed to render report: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
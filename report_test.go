@@ -0,0 +1,69 @@
+package impact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenderCommandFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "impact-render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "report.txt")
+	report := "# Run tag: test\n0000, P!, example.com/a, 0, , , , , \n"
+	if err := ioutil.WriteFile(in, []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		format string
+		status int
+	}{
+		{"text", 0},
+		{"html", 0},
+		{"json", 1},
+		{"junit", 1},
+		{"csv", 1},
+	} {
+		out := filepath.Join(dir, "report."+test.format)
+		status := renderCommand([]string{"--in=" + in, "--out=" + out, "--format=" + test.format})
+		if status != test.status {
+			t.Errorf("rendering to %s exited %d, want %d", test.format, status, test.status)
+		}
+
+		// a format it can't render shouldn't leave an empty report behind
+		_, err := os.Stat(out)
+		if exists := err == nil; exists != (test.status == 0) {
+			t.Errorf("rendering to %s exited %d, but the report exists is %v", test.format, status, exists)
+		}
+	}
+}
+
+func TestJSONReportExits(t *testing.T) {
+	rpy := reply{pkg: pkg{slug: "example.com/a"}, result: failedPostPatchTest}
+	rpy.recordExit("fetch", nil)
+	rpy.recordExit("post-test", errors.New("can't run"))
+
+	var buf bytes.Buffer
+	if err := writeJSONReport(&buf, []reply{rpy}); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []ReportRecord
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	want := []ExitStatus{{Phase: "fetch"}, {Phase: "post-test", Code: -1}}
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Exits, want) {
+		t.Errorf("got %+v, want exits %+v", records, want)
+	}
+}
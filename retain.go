@@ -0,0 +1,83 @@
+package impact
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// parseRetention interprets a --retain-logs policy: a comma separated list
+// of result codes, or of the classes "all", "regressions" and "warnings",
+// whose logs should be kept. Regressions' logs are always kept, as they're
+// the evidence for what the patch broke.
+func parseRetention(spec string) (map[testResult]bool, error) {
+	retain := make(map[testResult]bool)
+	for r := testResult(0); r <= passed; r++ {
+		if isRegression(r) {
+			retain[r] = true
+		}
+	}
+
+	for _, class := range strings.Split(spec, ",") {
+		switch class = strings.TrimSpace(class); class {
+		case "all":
+			for r := testResult(0); r <= passed; r++ {
+				retain[r] = true
+			}
+
+		case "regressions":
+
+		case "warnings":
+			for r := testResult(0); r <= passed; r++ {
+				if isWarning(r) {
+					retain[r] = true
+				}
+			}
+
+		default:
+			r, err := parseResultCode(class)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid --retain-logs class %q", class)
+			}
+			retain[r] = true
+		}
+	}
+	return retain, nil
+}
+
+// discardLogs deletes a package's logs. Logs kept in the workdir are
+// picked out from amongst the package's sources; a separate log dir is
+// removed wholesale.
+func discardLogs(rpy reply, workdir string) error {
+	if rpy.logDir == "" {
+		return nil
+	}
+	if rpy.logDir != workdir {
+		return removeTree(rpy.logDir)
+	}
+
+	entries, err := ioutil.ReadDir(rpy.logDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !isLogFile(e.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(rpy.logDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLogFile reports whether a file in a package's log dir is one of its
+// logs.
+func isLogFile(name string) bool {
+	return strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".json")
+}
@@ -0,0 +1,102 @@
+package impact
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fetchPhase = "fetch"
+	testPhase  = "test"
+	patchPhase = "patch"
+)
+
+// retryPolicy says how many times a failed phase should be retried, and how
+// long to wait before the first retry. The wait doubles on each subsequent
+// retry.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+}
+
+// retry calls attempt until it succeeds or the policy's retries are used
+// up, reporting whether the final attempt succeeded.
+func (p retryPolicy) retry(attempt func(n int) bool) bool {
+	delay := p.backoff
+	for n := 0; ; n++ {
+		if attempt(n) {
+			return true
+		}
+
+		if n >= p.retries {
+			return false
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryPolicies holds the retry policy for each phase of a package check,
+// and doubles as the value for the --retry command line flag, which takes
+// entries of the form "phase=count[:backoff]".
+type retryPolicies map[string]retryPolicy
+
+func (r retryPolicies) String() string {
+	phases := make([]string, 0, len(r))
+	for phase := range r {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+
+	entries := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		p := r[phase]
+		entries = append(entries, fmt.Sprintf("%s=%d:%s", phase, p.retries, p.backoff))
+	}
+	return strings.Join(entries, ",")
+}
+
+func (r retryPolicies) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid retry policy %q: expected phase=count[:backoff]", entry)
+		}
+
+		phase := strings.TrimSpace(parts[0])
+		switch phase {
+		case fetchPhase, testPhase:
+
+		case patchPhase:
+			// patch application isn't idempotent, so a half-applied patch
+			// would only fail again
+			return errors.New("Patch failures are never retried")
+
+		default:
+			return fmt.Errorf("Unknown phase %q in retry policy", phase)
+		}
+
+		var policy retryPolicy
+		spec := strings.SplitN(parts[1], ":", 2)
+		count, err := strconv.Atoi(strings.TrimSpace(spec[0]))
+		if err != nil || count < 0 {
+			return fmt.Errorf("Invalid retry count in %q", entry)
+		}
+		policy.retries = count
+
+		if len(spec) == 2 {
+			policy.backoff, err = time.ParseDuration(strings.TrimSpace(spec[1]))
+			if err != nil {
+				return fmt.Errorf("Invalid retry backoff in %q: %s", entry, err.Error())
+			}
+		}
+
+		r[phase] = policy
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package impact
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Runner owns the pool of workers that check packages against the patch.
+type Runner struct {
+	args    arguments
+	events  *eventLog
+	session *session
+
+	// limits how many packages can be in the build/test phase at once
+	buildSlots chan struct{}
+
+	cache *checkoutCache
+
+	// how many packages are being checked right now
+	inFlight int32
+}
+
+// NewRunner makes a Runner for callers using impact as a package, set up
+// from cfg.Args as the command line tool would be. cfg.Packages is ignored;
+// the packages to check are given to Stream.
+func NewRunner(cfg Config) (*Runner, error) {
+	args, err := parseArgs(cfg.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRunner(args)
+	if args.cacheDir != "" {
+		r.cache, err = newCheckoutCache(args.cacheDir, args.mode, int64(args.cacheMaxSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func newRunner(args arguments) *Runner {
+	concurrency := args.concurrency
+	if args.twoPhase {
+		concurrency = args.testConcurrency
+	}
+	slots := buildSlots(args.console(), concurrency, args.buildMemory)
+	if slots < concurrency {
+		fmt.Fprintf(args.console(), "Limiting to %d simultaneous builds to conserve memory\n", slots)
+	}
+
+	return &Runner{
+		args:       args,
+		session:    newSession(args),
+		buildSlots: make(chan struct{}, slots),
+	}
+}
+
+// Stream checks each of the supplied packages and delivers a Reply for each
+// one as soon as it completes, so the caller can react to results as they
+// arrive rather than waiting for the whole run. Replies arrive in completion
+// order, not list order; a Reply's Index is the package's position in pkgs.
+// The channel is closed once every package has been checked or, if ctx is
+// cancelled, once the in-flight workers have wound down. Cancelling ctx
+// kills the fetches and tests under way, and for good: the Runner can't be
+// used again. Packages not yet started when ctx is cancelled are never
+// checked, and replies completed after cancellation are dropped.
+func (r *Runner) Stream(ctx context.Context, pkgs []Package) <-chan Reply {
+	internal := make([]pkg, 0, len(pkgs))
+	for i, p := range pkgs {
+		internal = append(internal, pkg{
+			index:     i,
+			slug:      p.Slug,
+			version:   p.Version,
+			env:       p.Env,
+			recursive: r.args.recursive,
+		})
+	}
+
+	replies := make(chan Reply)
+	go func() {
+		defer close(replies)
+		for rpy := range r.stream(ctx, internal) {
+			select {
+			case replies <- exportReply(rpy):
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return replies
+}
+
+// stream is Stream for packages as the run loads them, delivering their
+// replies as they are.
+func (r *Runner) stream(ctx context.Context, pkgs []pkg) <-chan reply {
+	rpyChan := make(chan reply, 10)
+	deliver := func(rpy reply) {
+		select {
+		case rpyChan <- rpy:
+		case <-ctx.Done():
+		}
+	}
+
+	// stop the commands the workers are running as soon as ctx is
+	// cancelled, rather than waiting for them to finish
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.session.stop()
+
+		case <-finished:
+		}
+	}()
+
+	go func() {
+		defer close(rpyChan)
+		defer close(finished)
+		if !r.args.twoPhase {
+			r.pool(ctx, r.args.concurrency, len(pkgs), func(worker, i int) {
+				deliver(r.check(worker, pkgs[i]))
+			})
+			return
+		}
+
+		// with --two-phase, everything is fetched before anything is
+		// tested, so that slow downloads and slow tests don't hold each
+		// other up. Packages that fail to fetch are done with straight
+		// away; the rest wait, in list order, for the test phase.
+		fetched := make([]*reply, len(pkgs))
+		r.pool(ctx, r.args.fetchConcurrency, len(pkgs), func(worker, i int) {
+			rpy, ok := r.checkoutOnly(worker, pkgs[i])
+			if !ok {
+				deliver(rpy)
+				return
+			}
+			fetched[i] = &rpy
+		})
+
+		tests := make([]reply, 0, len(pkgs))
+		for _, rpy := range fetched {
+			if rpy != nil {
+				tests = append(tests, *rpy)
+			}
+		}
+		r.pool(ctx, r.args.testConcurrency, len(tests), func(worker, i int) {
+			deliver(r.testCheckedOut(worker, tests[i]))
+		})
+	}()
+
+	return rpyChan
+}
+
+// pool runs work for each of count jobs on n workers, numbered from 0, and
+// returns once they're all done. Jobs not yet started when ctx is cancelled
+// are never run.
+func (r *Runner) pool(ctx context.Context, n, count int, work func(worker, job int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	// fork the workers
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for job := range jobs {
+				work(i, job)
+			}
+		}(i)
+	}
+
+	// start feeding the jobs to the workers...
+	func() {
+		defer close(jobs)
+		for job := 0; job < count; job++ {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+func (r *Runner) check(idx int, p pkg) reply {
+	s := r.session
+	atomic.AddInt32(&r.inFlight, 1)
+	defer atomic.AddInt32(&r.inFlight, -1)
+
+	rpy := reply{pkg: p, result: failedUnexpectedly, worker: idx}
+	if p.isStandard() {
+		fmt.Fprintf(s.progress, "%04d: %d %s is in the standard library. Skipping.\n", p.index, idx, p.slug)
+		rpy.result = notExternal
+		r.events.emitDone(p, idx, rpy)
+		return rpy
+	}
+
+	start := time.Now()
+	workdir, err := r.workdir(&rpy)
+	if err == nil {
+		r.events.emit(p, idx, "start", "")
+		rpy.result, err = r.quickCheck(idx, &rpy, workdir)
+	}
+	rpy.err_ = err
+	rpy.duration = time.Since(start)
+	r.events.emitDone(p, idx, rpy)
+	return rpy
+}
+
+// checkoutOnly is the first half of check, for the fetch phase of a
+// two-phase run. It reports whether the package was checked out and is
+// ready for testCheckedOut; if not, its reply is final.
+func (r *Runner) checkoutOnly(idx int, p pkg) (reply, bool) {
+	s := r.session
+	atomic.AddInt32(&r.inFlight, 1)
+	defer atomic.AddInt32(&r.inFlight, -1)
+
+	rpy := reply{pkg: p, result: failedUnexpectedly, worker: idx}
+	if p.isStandard() {
+		fmt.Fprintf(s.progress, "%04d: %d %s is in the standard library. Skipping.\n", p.index, idx, p.slug)
+		rpy.result = notExternal
+		r.events.emitDone(p, idx, rpy)
+		return rpy, false
+	}
+
+	start := time.Now()
+	workdir, err := r.workdir(&rpy)
+	if err == nil {
+		r.events.emit(p, idx, "start", "")
+		rpy.result, err = r.checkout(idx, &rpy, workdir)
+	}
+	rpy.err_ = err
+	rpy.duration = time.Since(start)
+	if rpy.result == passed && err == nil {
+		return rpy, true
+	}
+	r.events.emitDone(p, idx, rpy)
+	return rpy, false
+}
+
+// testCheckedOut is the second half of check, for the test phase of a
+// two-phase run, picking up where checkoutOnly left off. The time spent
+// waiting between the phases isn't counted towards the package's duration.
+func (r *Runner) testCheckedOut(idx int, rpy reply) reply {
+	atomic.AddInt32(&r.inFlight, 1)
+	defer atomic.AddInt32(&r.inFlight, -1)
+
+	rpy.worker = idx
+	start := time.Now()
+	workdir, err := r.workdir(&rpy)
+	if err == nil {
+		rpy.result, err = r.test(idx, &rpy, workdir)
+	}
+	rpy.err_ = err
+	rpy.duration += time.Since(start)
+	r.events.emitDone(rpy.pkg, idx, rpy)
+	return rpy
+}
+
+// workdir works out where a package is checked out, and sets where its
+// logs go.
+func (r *Runner) workdir(rpy *reply) (string, error) {
+	workdir, err := filepath.Abs(path.Join(r.args.workRoot, fmt.Sprintf("%04d", rpy.index)))
+	rpy.logDir = workdir
+	if r.args.logRoot != "" {
+		rpy.logDir = path.Join(r.args.logRoot, fmt.Sprintf("%04d", rpy.index))
+	}
+	return workdir, err
+}
+
+// InFlight reports how many packages are being checked right now.
+func (r *Runner) InFlight() int {
+	return int(atomic.LoadInt32(&r.inFlight))
+}
@@ -0,0 +1,133 @@
+package impact
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// samplePackages picks a random subset of about fraction of the packages,
+// keeping their order. Packages are weighted by popularity if they have
+// one, so that a sample reflects the ecosystem as its users see it. It
+// also returns the chance each package had of being picked, by name, for
+// sampledRate to undo the weighting with.
+func samplePackages(pkgs []pkg, fraction float64, seed int64) ([]pkg, map[string]float64) {
+	n := int(math.Ceil(fraction * float64(len(pkgs))))
+	inclusion := inclusionProbabilities(pkgs, n)
+	if n >= len(pkgs) {
+		return pkgs, inclusion
+	}
+
+	// weighted sampling without replacement: give each package a random
+	// key of u^(1/w) and take the n largest
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([]float64, len(pkgs))
+	order := make([]int, len(pkgs))
+	for i, p := range pkgs {
+		weight := float64(p.importers + 1)
+		keys[i] = math.Pow(rng.Float64(), 1/weight)
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] > keys[order[b]] })
+
+	chosen := order[:n]
+	sort.Ints(chosen)
+	sample := make([]pkg, 0, n)
+	for _, i := range chosen {
+		sample = append(sample, pkgs[i])
+	}
+	return sample, inclusion
+}
+
+// inclusionProbabilities approximates the chance each package has of being
+// among n sampled in proportion to its weight, by name. A package's chance
+// is n times its share of the weight, except that those whose share would
+// give them a chance of more than one are certain to be picked, and leave
+// the rest of the sample to the others.
+func inclusionProbabilities(pkgs []pkg, n int) map[string]float64 {
+	inclusion := make(map[string]float64, len(pkgs))
+	if n >= len(pkgs) {
+		for _, p := range pkgs {
+			inclusion[p.name()] = 1
+		}
+		return inclusion
+	}
+
+	certain := make(map[int]bool)
+	for {
+		total := 0.0
+		for i, p := range pkgs {
+			if !certain[i] {
+				total += float64(p.importers + 1)
+			}
+		}
+
+		remaining := float64(n - len(certain))
+		capped := false
+		for i, p := range pkgs {
+			if !certain[i] && remaining*float64(p.importers+1)/total >= 1 {
+				certain[i] = true
+				capped = true
+			}
+		}
+		if capped {
+			continue
+		}
+
+		for i, p := range pkgs {
+			inclusion[p.name()] = 1
+			if !certain[i] {
+				inclusion[p.name()] = remaining * float64(p.importers+1) / total
+			}
+		}
+		return inclusion
+	}
+}
+
+// sampledRate estimates the regression rate across all of the packages the
+// sample was drawn from, along with its 95% confidence interval and the
+// number of testable packages in the sample. Each package counts for the
+// inverse of its chance of being sampled, so that the weighting towards
+// popular packages doesn't skew the estimate, and the interval is a Wilson
+// interval for the sample size those unequal weights are worth.
+func sampledRate(results []reply, inclusion map[string]float64) (float64, float64, float64, int) {
+	var sum, sumSquares, regressed float64
+	testable := 0
+	for _, r := range results {
+		if !isTestable(r.result) {
+			continue
+		}
+		weight := 1.0
+		if pi := inclusion[r.listedName()]; pi > 0 {
+			weight = 1 / pi
+		}
+
+		testable++
+		sum += weight
+		sumSquares += weight * weight
+		if isRegression(r.result) {
+			regressed += weight
+		}
+	}
+	if testable == 0 {
+		return 0, 0, 1, 0
+	}
+
+	rate := regressed / sum
+	low, high := wilsonInterval(rate, sum*sum/sumSquares)
+	return rate, low, high, testable
+}
+
+// wilsonInterval is the 95% Wilson score interval for a proportion p
+// observed in n trials. It behaves far better than the textbook normal
+// approximation for the small rates and samples typical of regressions.
+func wilsonInterval(p, nf float64) (float64, float64) {
+	if nf == 0 {
+		return 0, 1
+	}
+
+	const z = 1.96
+	centre := (p + z*z/(2*nf)) / (1 + z*z/nf)
+	margin := z * math.Sqrt(p*(1-p)/nf+z*z/(4*nf*nf)) / (1 + z*z/nf)
+	return math.Max(0, centre-margin), math.Min(1, centre+margin)
+}
@@ -0,0 +1,73 @@
+package impact
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInclusionProbabilities(t *testing.T) {
+	pkgs := []pkg{
+		{slug: "example.com/popular", importers: 999},
+		{slug: "example.com/a"},
+		{slug: "example.com/b"},
+		{slug: "example.com/c"},
+		{slug: "example.com/d", importers: 1},
+	}
+
+	inclusion := inclusionProbabilities(pkgs, 2)
+	// the popular package is certain to be picked, leaving one place for
+	// the other four to share by weight
+	want := map[string]float64{
+		"example.com/popular": 1,
+		"example.com/a":       0.2,
+		"example.com/b":       0.2,
+		"example.com/c":       0.2,
+		"example.com/d":       0.4,
+	}
+	for name, pi := range want {
+		if math.Abs(inclusion[name]-pi) > 1e-9 {
+			t.Errorf("%s has chance %g, want %g", name, inclusion[name], pi)
+		}
+	}
+}
+
+func TestSampledRate(t *testing.T) {
+	// a popular package that regressed, sampled for certain, and four
+	// obscure ones that were each only twice as likely to be left out, one
+	// of which regressed as well
+	inclusion := map[string]float64{
+		"example.com/popular": 1,
+		"example.com/a":       0.5,
+		"example.com/b":       0.5,
+		"example.com/c":       0.5,
+		"example.com/d":       0.5,
+	}
+	results := []reply{
+		{pkg: pkg{slug: "example.com/popular"}, result: failedPostPatchTest},
+		{pkg: pkg{slug: "example.com/a"}, result: failedPostPatchTest},
+		{pkg: pkg{slug: "example.com/b"}, result: passed},
+		{pkg: pkg{slug: "example.com/c"}, result: passed},
+		{pkg: pkg{slug: "example.com/d"}, result: passed},
+		{pkg: pkg{slug: "example.com/e"}, result: noTests},
+	}
+
+	rate, low, high, testable := sampledRate(results, inclusion)
+	if testable != 5 {
+		t.Errorf("%d testable packages, want 5", testable)
+	}
+	// the obscure packages stand for twice as many, so 3 of 9 regressed,
+	// rather than the 2 of 5 in the sample
+	if math.Abs(rate-1.0/3) > 1e-9 {
+		t.Errorf("rate %g, want 1/3", rate)
+	}
+	if low >= rate || high <= rate || low < 0 || high > 1 {
+		t.Errorf("interval %g-%g doesn't sensibly contain %g", low, high, rate)
+	}
+
+	// unequal weights are worth fewer packages than equal ones, so the
+	// interval is wider than for an unweighted sample of the same size
+	unweightedLow, unweightedHigh := wilsonInterval(rate, float64(testable))
+	if high-low <= unweightedHigh-unweightedLow {
+		t.Errorf("interval %g-%g no wider than unweighted %g-%g", low, high, unweightedLow, unweightedHigh)
+	}
+}
@@ -0,0 +1,85 @@
+package impact
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+)
+
+// selfCheck checks the first n packages twice over, side by side, so that
+// each copy lands on a different worker, and lists any whose two results
+// differ. Packages should get the same result wherever they run, so a
+// difference means the workers aren't as isolated from each other as they
+// ought to be. The copies are checked in work directories of their own,
+// numbered after the real packages, which are removed afterwards.
+func selfCheck(ctx context.Context, runner *Runner, pkgs []pkg, n int, workRoot string) ([]string, error) {
+	base := 0
+	for _, p := range pkgs {
+		if p.index >= base {
+			base = p.index + 1
+		}
+	}
+
+	twins := make([]pkg, 0, 2*n)
+	for _, p := range pkgs {
+		if len(twins) == 2*n {
+			break
+		}
+		if p.isStandard() {
+			continue
+		}
+
+		for i := 0; i < 2; i++ {
+			twin := p
+			twin.index = base + len(twins)
+			twins = append(twins, twin)
+		}
+	}
+
+	// stop what's under way if ctx is cancelled, as stream would
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			runner.session.stop()
+
+		case <-finished:
+		}
+	}()
+
+	// each pair of twins gets a pair of workers to itself, so that the twins
+	// are always checked side by side, on different workers
+	results := make([]reply, len(twins))
+	runner.pool(ctx, runner.args.concurrency/2, len(twins)/2, func(worker, pair int) {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[2*pair+i] = runner.check(2*worker+i, twins[2*pair+i])
+			}(i)
+		}
+		wg.Wait()
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	mismatches := make([]string, 0)
+	for i := 0; i < len(twins); i += 2 {
+		a, b := results[i], results[i+1]
+		if a.result != b.result {
+			mismatches = append(mismatches, fmt.Sprintf("%s: worker %d gave %s, worker %d gave %s",
+				twins[i].name(), a.worker, resultCode(a.result), b.worker, resultCode(b.result)))
+		}
+	}
+
+	for _, p := range twins {
+		if err := removeTree(path.Join(workRoot, fmt.Sprintf("%04d", p.index))); err != nil {
+			return mismatches, err
+		}
+	}
+	return mismatches, nil
+}
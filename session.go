@@ -0,0 +1,82 @@
+package impact
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// session holds what everything checking packages for a single run
+// shares, so that runs in the same process don't interfere.
+type session struct {
+	// progress is where the running commentary on each package goes: what
+	// it's doing, and the output of the commands it runs
+	progress io.Writer
+
+	// the process groups of the fetches and test runs under way. Each is
+	// in a group of its own so that a timeout can kill everything it
+	// started, which also puts it out of reach of the terminal's ^C, so
+	// they have to be killed explicitly when the run is cut short.
+	mu      sync.Mutex
+	groups  map[int]bool
+	stopped bool
+}
+
+func newSession(args arguments) *session {
+	s := &session{progress: os.Stdout, groups: make(map[int]bool)}
+	if args.logFormat != logFormatVerbose {
+		s.progress = ioutil.Discard
+	}
+	return s
+}
+
+// errStopped means a command wasn't started because the run has been cut
+// short.
+var errStopped = errors.New("The run was stopped")
+
+// start starts cmd in a process group of its own, which is tracked until
+// finished is called, so that stop can kill it.
+func (s *session) start(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return errStopped
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.groups[cmd.Process.Pid] = true
+	return nil
+}
+
+// finished stops tracking a command started with start, once it's been
+// waited for.
+func (s *session) finished(cmd *exec.Cmd) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, cmd.Process.Pid)
+}
+
+// stop kills every command that's under way, along with anything they've
+// started, and refuses to start any more.
+func (s *session) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for pid := range s.groups {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+}
+
+// isStopped reports whether the run has been cut short.
+func (s *session) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
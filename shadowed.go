@@ -0,0 +1,60 @@
+package impact
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// touchesModFile reports whether a patch changes the go.mod or go.sum of
+// the module it applies to.
+func touchesModFile(patchFile string, strip int) (bool, error) {
+	files, err := patchedFiles(patchFile, strip)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		if f == "go.mod" || f == "go.sum" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// shadowedTargets lists the patched packages whose go.mod changes the
+// package under test won't see. A package with its own go.mod builds
+// against whichever version of the patched module it selects, and unless
+// that resolves to the patched source, a change to the patched module's
+// go.mod is invisible to it.
+func shadowedTargets(p pkg, targets []target, strip int, dir string, env []string) ([]string, error) {
+	modDir := path.Join(dir, "src", p.slug)
+	if _, err := os.Stat(path.Join(modDir, "go.mod")); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	shadowed := make([]string, 0)
+	for _, t := range targets {
+		touches, err := touchesModFile(t.patchFile, strip)
+		if err != nil {
+			return nil, err
+		}
+		if !touches {
+			continue
+		}
+
+		list := goCommand(env, "list", "-f", "{{.Dir}}", t.packageName)
+		list.Dir = modDir
+		out, err := list.Output()
+		if err != nil {
+			// not a dependency at all, so nothing to shadow
+			continue
+		}
+
+		selected, _ := filepath.Abs(strings.TrimSpace(string(out)))
+		if selected != path.Join(dir, "src", t.packageName) {
+			shadowed = append(shadowed, t.packageName)
+		}
+	}
+	return shadowed, nil
+}
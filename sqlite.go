@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS results (
+	run_id      TEXT NOT NULL,
+	idx         INTEGER NOT NULL,
+	slug        TEXT NOT NULL,
+	result      TEXT NOT NULL,
+	description TEXT NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	disk_usage  INTEGER NOT NULL,
+	error       TEXT,
+	timestamp   TEXT NOT NULL
+);
+`
+
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// exportSQLite appends a run's results to the results table in a SQLite
+// database, creating the table if need be, so that results can be queried
+// across runs. It drives the sqlite3 command line tool rather than linking
+// against SQLite directly.
+func exportSQLite(filename, runID string, timestamp time.Time, results []reply) error {
+	var script bytes.Buffer
+	script.WriteString(sqliteSchema)
+	script.WriteString("BEGIN TRANSACTION;\n")
+	for _, r := range results {
+		errText := "NULL"
+		if r.err_ != nil {
+			errText = sqlQuote(r.err_.Error())
+		}
+
+		fmt.Fprintf(&script,
+			"INSERT INTO results VALUES (%s, %d, %s, %s, %s, %d, %d, %s, %s);\n",
+			sqlQuote(runID), r.index, sqlQuote(r.name()),
+			sqlQuote(resultCode(r.result)), sqlQuote(r.result.Error()),
+			r.duration/time.Millisecond, r.diskUsage, errText,
+			sqlQuote(timestamp.UTC().Format(time.RFC3339)))
+	}
+	script.WriteString("COMMIT;\n")
+
+	cmd := exec.Command("sqlite3", "-bail", filename)
+	cmd.Stdin = &script
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
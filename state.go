@@ -0,0 +1,298 @@
+package impact
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// stateHeader opens the state log, identifying the run it belongs to.
+type stateHeader struct {
+	Run      string   `json:"run"`
+	Packages []string `json:"packages"`
+}
+
+// savedPatch is a patchStatus as recorded in the state log.
+type savedPatch struct {
+	PackageName string `json:"package"`
+	Result      string `json:"result"`
+	Hunks       int    `json:"hunks,omitempty"`
+	Rejected    int    `json:"rejected,omitempty"`
+	PatchFile   string `json:"patch_file,omitempty"`
+	Replace     string `json:"replace,omitempty"`
+	LineEndings bool   `json:"line_endings,omitempty"`
+
+	Rejects []rejectedHunk `json:"rejects,omitempty"`
+}
+
+// savedReply is a completed package as recorded in the state log: as much
+// of its reply as the report and summaries need.
+type savedReply struct {
+	Index     int           `json:"index"`
+	Slug      string        `json:"slug"`
+	Version   string        `json:"version,omitempty"`
+	Result    string        `json:"result"`
+	Error     string        `json:"error,omitempty"`
+	DiskUsage int64         `json:"disk_usage"`
+	Duration  time.Duration `json:"duration"`
+	Patches   []savedPatch  `json:"patches,omitempty"`
+
+	FailedTests     []string `json:"failed_tests,omitempty"`
+	ResolvedVersion string   `json:"resolved_version,omitempty"`
+
+	// the package as listed, if the row is a sub-package's
+	Listed string `json:"listed,omitempty"`
+
+	Exits []ExitStatus `json:"exits,omitempty"`
+
+	FetchTime    time.Duration `json:"fetch_time,omitempty"`
+	PreTestTime  time.Duration `json:"pre_test_time,omitempty"`
+	PostTestTime time.Duration `json:"post_test_time,omitempty"`
+}
+
+// parseResultCode turns a code from resultCode back into a result.
+func parseResultCode(code string) (testResult, error) {
+	for r := testResult(0); r <= passed; r++ {
+		if resultCode(r) == code {
+			return r, nil
+		}
+	}
+	return failedUnexpectedly, fmt.Errorf("Unknown result code %q", code)
+}
+
+func saveReply(r reply) savedReply {
+	s := savedReply{
+		Index:     r.index,
+		Slug:      r.slug,
+		Version:   r.version,
+		Result:    resultCode(r.result),
+		DiskUsage: r.diskUsage,
+		Duration:  r.duration,
+
+		FailedTests:     r.failedTests(),
+		ResolvedVersion: r.resolvedVersion,
+		Listed:          r.listed,
+		Exits:           r.exits,
+
+		FetchTime:    r.fetchTime,
+		PreTestTime:  r.preTestTime,
+		PostTestTime: r.postTestTime,
+	}
+	if r.err_ != nil {
+		s.Error = r.err_.Error()
+	}
+	for _, p := range r.patches {
+		s.Patches = append(s.Patches, savedPatch{
+			PackageName: p.packageName,
+			Result:      resultCode(p.result),
+			Hunks:       p.hunks,
+			Rejected:    p.rejected,
+			PatchFile:   p.patchFile,
+			Replace:     p.replace,
+			LineEndings: p.lineEndings,
+			Rejects:     p.rejects,
+		})
+	}
+	return s
+}
+
+func (s savedReply) restore() (reply, error) {
+	r := reply{
+		pkg:       pkg{index: s.Index, slug: s.Slug, version: s.Version},
+		diskUsage: s.DiskUsage,
+		duration:  s.Duration,
+
+		resolvedVersion: s.ResolvedVersion,
+		listed:          s.Listed,
+		exits:           s.Exits,
+
+		fetchTime:    s.FetchTime,
+		preTestTime:  s.PreTestTime,
+		postTestTime: s.PostTestTime,
+	}
+
+	var err error
+	r.result, err = parseResultCode(s.Result)
+	if err != nil {
+		return r, err
+	}
+	if s.Error != "" {
+		r.err_ = errors.New(s.Error)
+	}
+	for _, test := range s.FailedTests {
+		r.failures = append(r.failures, testFailure{test: test})
+	}
+
+	for _, p := range s.Patches {
+		status := patchStatus{
+			packageName: p.PackageName,
+			hunks:       p.Hunks,
+			rejected:    p.Rejected,
+			patchFile:   p.PatchFile,
+			replace:     p.Replace,
+			lineEndings: p.LineEndings,
+			rejects:     p.Rejects,
+		}
+		status.result, err = parseResultCode(p.Result)
+		if err != nil {
+			return r, err
+		}
+		r.patches = append(r.patches, status)
+	}
+	return r, nil
+}
+
+// stateLog records each result as it arrives, so that a run that dies
+// part way through can be continued. It's append-only, one JSON document
+// per line, so a crash mid-write costs at most the line being written.
+type stateLog struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+// createStateLog starts the state log for a new run.
+func createStateLog(filename, runTag string, pkgs []pkg) (*stateLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	header := stateHeader{Run: runTag, Packages: make([]string, 0, len(pkgs))}
+	for _, p := range pkgs {
+		header.Packages = append(header.Packages, p.name())
+	}
+
+	l := &stateLog{file: file, enc: json.NewEncoder(file)}
+	if err := l.enc.Encode(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, file.Sync()
+}
+
+// continueStateLog reopens the state log of an interrupted run, returning
+// the run's tag and the results it had already collected. The package list
+// needn't be the one the run started with; see resumePackages.
+func continueStateLog(filename string) (*stateLog, string, []reply, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	if !s.Scan() {
+		return nil, "", nil, fmt.Errorf("%s: missing header", filename)
+	}
+	var header stateHeader
+	if err := json.Unmarshal(s.Bytes(), &header); err != nil {
+		return nil, "", nil, fmt.Errorf("%s: bad header: %s", filename, err.Error())
+	}
+
+	// track the end of the last complete line, so that anything the run
+	// died part way through writing can be cut off before appending
+	good := int64(len(s.Bytes()) + 1)
+	completed := make([]reply, 0)
+	for s.Scan() {
+		var saved savedReply
+		if err := json.Unmarshal(s.Bytes(), &saved); err != nil {
+			break
+		}
+		good += int64(len(s.Bytes()) + 1)
+
+		r, err := saved.restore()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		completed = append(completed, r)
+	}
+	if s.Err() != nil {
+		return nil, "", nil, s.Err()
+	}
+
+	if err := os.Truncate(filename, good); err != nil {
+		return nil, "", nil, err
+	}
+	appendFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return &stateLog{file: appendFile, enc: json.NewEncoder(appendFile)}, header.Run, completed, nil
+}
+
+// record adds a completed package to the state log.
+func (l *stateLog) record(r reply) error {
+	if err := l.enc.Encode(saveReply(r)); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *stateLog) close() error {
+	return l.file.Close()
+}
+
+// resumePackages picks up a continued run with the current package list,
+// returning the packages still to check and the recorded results that are
+// still wanted. Packages are matched to their results by name, so packages
+// can be added to or removed from the list between runs, and a package
+// listed n times is checked n times. Pending packages whose workdir numbers
+// were taken by recorded ones are renumbered in pkgs itself, so that the
+// caller's copy of the list matches the workdirs.
+func resumePackages(pkgs []pkg, completed []reply) ([]pkg, []reply) {
+	// the rows split out of a recursive package share its number, and are
+	// only the one package between them
+	type recorded struct {
+		name  string
+		index int
+	}
+	seen := make(map[recorded]bool)
+	done := make(map[string]int)
+	taken := make(map[int]bool)
+	next := 0
+	for _, r := range completed {
+		key := recorded{r.listedName(), r.index}
+		if !seen[key] {
+			seen[key] = true
+			done[key.name]++
+		}
+		taken[r.index] = true
+		if r.index >= next {
+			next = r.index + 1
+		}
+	}
+	for _, p := range pkgs {
+		if p.index >= next {
+			next = p.index + 1
+		}
+	}
+
+	listed := make(map[string]bool)
+	pending := make([]pkg, 0, len(pkgs))
+	for i := range pkgs {
+		name := pkgs[i].name()
+		listed[name] = true
+		if done[name] > 0 {
+			done[name]--
+			continue
+		}
+
+		if taken[pkgs[i].index] {
+			pkgs[i].index = next
+			next++
+		}
+		pending = append(pending, pkgs[i])
+	}
+
+	wanted := make([]reply, 0, len(completed))
+	for _, r := range completed {
+		if listed[r.listedName()] {
+			wanted = append(wanted, r)
+		}
+	}
+	return pending, wanted
+}
@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"testing"
+)
+
+func TestResumePackages(t *testing.T) {
+	// the run started with a, b, a and c, and got as far as a, b and c
+	completed := []reply{
+		{pkg: pkg{index: 0, slug: "example.com/a"}},
+		{pkg: pkg{index: 1, slug: "example.com/b"}},
+		{pkg: pkg{index: 3, slug: "example.com/c"}},
+	}
+
+	// since then, b has been dropped from the list and d added
+	pkgs := []pkg{
+		{index: 0, slug: "example.com/a"},
+		{index: 1, slug: "example.com/a"},
+		{index: 2, slug: "example.com/c"},
+		{index: 3, slug: "example.com/d"},
+	}
+
+	pending, wanted := resumePackages(pkgs, completed)
+	if len(pending) != 2 || pending[0].slug != "example.com/a" || pending[1].slug != "example.com/d" {
+		t.Fatalf("wrong packages pending: %v", pending)
+	}
+	// the numbers of a's second listing and of d are the workdirs of b and
+	// c, so they need new ones
+	if pending[0].index != 4 || pkgs[1].index != 4 {
+		t.Errorf("a numbered %d, and %d in the list, want 4", pending[0].index, pkgs[1].index)
+	}
+	if pending[1].index != 5 || pkgs[3].index != 5 {
+		t.Errorf("d numbered %d, and %d in the list, want 5", pending[1].index, pkgs[3].index)
+	}
+
+	if len(wanted) != 2 || wanted[0].slug != "example.com/a" || wanted[1].slug != "example.com/c" {
+		t.Errorf("wrong results kept: %v", wanted)
+	}
+}
+
+func TestResumeRecursivePackages(t *testing.T) {
+	completed := []reply{
+		{pkg: pkg{index: 0, slug: "example.com/a"}, listed: "example.com/a"},
+		{pkg: pkg{index: 0, slug: "example.com/a/b"}, listed: "example.com/a"},
+	}
+	pkgs := []pkg{
+		{index: 0, slug: "example.com/a", recursive: true},
+		{index: 1, slug: "example.com/e", recursive: true},
+	}
+
+	pending, wanted := resumePackages(pkgs, completed)
+	if len(pending) != 1 || pending[0].slug != "example.com/e" {
+		t.Errorf("wrong packages pending: %v", pending)
+	}
+	if len(wanted) != 2 {
+		t.Errorf("got %d sub-package results, want 2", len(wanted))
+	}
+}
@@ -0,0 +1,193 @@
+package impact
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// testEvent is a single event from `go test -json`.
+type testEvent struct {
+	Time    time.Time `json:"Time"`
+	Action  string    `json:"Action"`
+	Package string    `json:"Package"`
+	Test    string    `json:"Test"`
+	Elapsed float64   `json:"Elapsed"`
+	Output  string    `json:"Output"`
+}
+
+// testOutcome is how a single test went, according to `go test -json`.
+type testOutcome struct {
+	Package  string        `json:"package"`
+	Test     string        `json:"test"`
+	Action   string        `json:"action"`
+	Duration time.Duration `json:"duration"`
+}
+
+// jsonLogName is where the raw `go test -json` stream behind a test log is
+// kept.
+func jsonLogName(logfile string) string {
+	return strings.TrimSuffix(logfile, ".log") + ".json"
+}
+
+// decodeTestJSON copies a `go test -json` stream into jsonLog untouched, and
+// writes the output it carries into textLog, giving the same log `go test
+// -v` would have. Anything in the stream that isn't an event is passed
+// through as text.
+func decodeTestJSON(r io.Reader, jsonLog, textLog io.Writer) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := s.Bytes()
+		var ev testEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			if _, err := textLog.Write(append(line, '\n')); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := jsonLog.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(textLog, ev.Output); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// readTestJSON reads the events from a `go test -json` log.
+func readTestJSON(filename string) ([]testEvent, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make([]testEvent, 0)
+	d := json.NewDecoder(file)
+	for {
+		var ev testEvent
+		err := d.Decode(&ev)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+}
+
+// testOutcomes picks the result of each test out of a `go test -json` log.
+func testOutcomes(filename string) ([]testOutcome, error) {
+	events, err := readTestJSON(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	outcomes := make([]testOutcome, 0)
+	for _, ev := range events {
+		switch ev.Action {
+		case "pass", "fail", "skip":
+			if ev.Test == "" {
+				continue
+			}
+			outcomes = append(outcomes, testOutcome{
+				Package:  ev.Package,
+				Test:     ev.Test,
+				Action:   ev.Action,
+				Duration: time.Duration(ev.Elapsed * float64(time.Second)),
+			})
+		}
+	}
+	return outcomes, nil
+}
+
+// jsonTestStats summarises a `go test -json` log, as parseTestLog does a
+// verbose one.
+func jsonTestStats(filename string) (testStats, error) {
+	var stats testStats
+	events, err := readTestJSON(filename)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, ev := range events {
+		if ev.Test == "" {
+			if strings.Contains(ev.Output, "[no test files]") {
+				stats.noTestFiles = true
+			}
+			continue
+		}
+		switch ev.Action {
+		case "run":
+			stats.run++
+
+		case "skip":
+			stats.skipped++
+		}
+	}
+	return stats, nil
+}
+
+// jsonFailures picks out the failing tests from a `go test -json` log, as
+// parseFailures does from a verbose one. The events name the test behind
+// every line of output, so there's no need to work out which test a
+// message belongs to.
+func jsonFailures(filename string) ([]testFailure, error) {
+	events, err := readTestJSON(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make([]string, 0)
+	messages := make(map[string][]testFailure)
+	for _, ev := range events {
+		if ev.Test == "" {
+			continue
+		}
+		switch ev.Action {
+		case "fail":
+			failed = append(failed, ev.Test)
+
+		case "output":
+			m := failureLocation.FindStringSubmatch(strings.TrimRight(ev.Output, "\n"))
+			if m == nil {
+				continue
+			}
+			n, _ := strconv.Atoi(m[2])
+			messages[ev.Test] = append(messages[ev.Test], testFailure{
+				test:    ev.Test,
+				file:    m[1],
+				line:    n,
+				message: m[3],
+			})
+		}
+	}
+
+	failures := make([]testFailure, 0, len(failed))
+	for _, test := range failed {
+		if msgs, ok := messages[test]; ok {
+			failures = append(failures, msgs...)
+			continue
+		}
+
+		hasFailedSubtest := false
+		for _, other := range failed {
+			if strings.HasPrefix(other, test+"/") {
+				hasFailedSubtest = true
+				break
+			}
+		}
+		if !hasFailedSubtest {
+			failures = append(failures, testFailure{test: test})
+		}
+	}
+	return failures, nil
+}
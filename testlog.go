@@ -0,0 +1,264 @@
+package impact
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// testStats summarises a verbose `go test` log.
+type testStats struct {
+	run     int
+	skipped int
+
+	// whether go test found a package without any test files
+	noTestFiles bool
+}
+
+func parseTestLog(filename string) (testStats, error) {
+	var stats testStats
+	if _, err := os.Stat(jsonLogName(filename)); err == nil {
+		return jsonTestStats(jsonLogName(filename))
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case strings.HasPrefix(line, "=== RUN"):
+			stats.run++
+
+		case strings.HasPrefix(line, "--- SKIP:"):
+			stats.skipped++
+
+		case strings.HasSuffix(line, "[no test files]"):
+			stats.noTestFiles = true
+		}
+	}
+
+	return stats, s.Err()
+}
+
+// skippedMore decides whether the post-patch run skipped (or simply failed
+// to run) at least threshold more tests than the pre-patch run did, which
+// suggests the patch has stopped tests from running rather than fixed them.
+// A threshold of 0 turns the check off.
+func skippedMore(pre, post testStats, threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+	return post.skipped-pre.skipped >= threshold || pre.run-post.run >= threshold
+}
+
+// largestTestDeltas picks out the (at most) n packages where the number of
+// tests run changed most post-patch, in either direction.
+func largestTestDeltas(results []reply, n int) []reply {
+	changed := make([]reply, 0)
+	for _, r := range results {
+		if r.testsCounted && r.postTests != r.preTests {
+			changed = append(changed, r)
+		}
+	}
+
+	magnitude := func(r reply) int {
+		if d := r.postTests - r.preTests; d < 0 {
+			return -d
+		}
+		return r.postTests - r.preTests
+	}
+	sort.SliceStable(changed, func(i, j int) bool {
+		return magnitude(changed[i]) > magnitude(changed[j])
+	})
+	if len(changed) > n {
+		changed = changed[:n]
+	}
+	return changed
+}
+
+// diffLogs writes a unified diff of two test logs to diffFile.
+func diffLogs(s *session, pre, post, diffFile string) error {
+	file, err := os.Create(diffFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cmd := exec.Command("diff", "-u", pre, post)
+	cmd.Stdout = file
+	cmd.Stderr = s.progress
+
+	// diff exits with 1 when the files differ, which is only to be
+	// expected
+	err = cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		return nil
+	}
+	return err
+}
+
+// logContains reports whether any line of a log file contains text.
+func logContains(filename, text string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		if strings.Contains(s.Text(), text) {
+			return true, nil
+		}
+	}
+
+	return false, s.Err()
+}
+
+// panicTrace extracts the first panic, and the goroutine traces that follow
+// it, from a test log. It's empty if the log holds no panic.
+func panicTrace(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	trace := make([]string, 0)
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := s.Text()
+		if len(trace) == 0 {
+			if strings.HasPrefix(line, "panic: ") {
+				trace = append(trace, line)
+			}
+			continue
+		}
+
+		// the trace ends where go test reports the package's outcome
+		if strings.HasPrefix(line, "FAIL") || strings.HasPrefix(line, "exit status ") {
+			break
+		}
+		trace = append(trace, line)
+	}
+
+	return strings.TrimSpace(strings.Join(trace, "\n")), s.Err()
+}
+
+// testFailure is a single failure reported by a test, with the location the
+// test reported it from, if it gave one.
+type testFailure struct {
+	test    string
+	file    string
+	line    int
+	message string
+}
+
+// failedTests lists the tests that failed post-patch, each once, in the
+// order they failed. Subtests are listed by their full name.
+func (r reply) failedTests() []string {
+	seen := make(map[string]bool)
+	tests := make([]string, 0)
+	for _, f := range r.failures {
+		if !seen[f.test] {
+			seen[f.test] = true
+			tests = append(tests, f.test)
+		}
+	}
+	return tests
+}
+
+var failureLocation = regexp.MustCompile(`^\s+([^\s:]+\.go):(\d+): (.*)$`)
+
+// parseFailures picks out the failing tests from a verbose `go test` log,
+// along with any file:line locations their failure messages carry. Newer
+// versions of Go log a test's messages as it runs, before its "--- FAIL"
+// line, while older ones log them afterwards, so both are handled. If the
+// tests were run with -json, the event stream is used instead.
+func parseFailures(filename string) ([]testFailure, error) {
+	if _, err := os.Stat(jsonLogName(filename)); err == nil {
+		return jsonFailures(jsonLogName(filename))
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	failed := make([]string, 0)
+	messages := make(map[string][]testFailure)
+	current := ""
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		// Go 1.20 and later mark a switch back to a test's output with
+		// "=== NAME" where earlier versions used "=== CONT"
+		case strings.HasPrefix(trimmed, "=== RUN"), strings.HasPrefix(trimmed, "=== CONT"),
+			strings.HasPrefix(trimmed, "=== NAME"):
+			current = ""
+			if fields := strings.Fields(trimmed); len(fields) > 2 {
+				current = fields[2]
+			}
+
+		case strings.HasPrefix(trimmed, "--- FAIL:"):
+			current = ""
+			if fields := strings.Fields(strings.TrimPrefix(trimmed, "--- FAIL:")); len(fields) > 0 {
+				current = fields[0]
+				failed = append(failed, current)
+			}
+
+		case strings.HasPrefix(trimmed, "--- "), strings.HasPrefix(trimmed, "=== "):
+			current = ""
+
+		case current != "":
+			m := failureLocation.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			n, _ := strconv.Atoi(m[2])
+			messages[current] = append(messages[current], testFailure{
+				test:    current,
+				file:    m[1],
+				line:    n,
+				message: m[3],
+			})
+		}
+	}
+
+	failures := make([]testFailure, 0, len(failed))
+	for _, test := range failed {
+		if msgs, ok := messages[test]; ok {
+			failures = append(failures, msgs...)
+			continue
+		}
+
+		// a test that failed only because a subtest did says nothing more
+		// than the subtest's own failure does
+		hasFailedSubtest := false
+		for _, other := range failed {
+			if strings.HasPrefix(other, test+"/") {
+				hasFailedSubtest = true
+				break
+			}
+		}
+		if !hasFailedSubtest {
+			failures = append(failures, testFailure{test: test})
+		}
+	}
+
+	return failures, s.Err()
+}
@@ -0,0 +1,26 @@
+package impact
+
+import (
+	"testing"
+)
+
+func TestSkippedMore(t *testing.T) {
+	pre := testStats{run: 20, skipped: 2}
+	for _, test := range []struct {
+		post      testStats
+		threshold int
+		want      bool
+	}{
+		// a test or two skipping itself on this machine isn't worth a warning
+		{testStats{run: 19, skipped: 3}, 5, false},
+		{testStats{run: 20, skipped: 6}, 5, false},
+		{testStats{run: 20, skipped: 7}, 5, true},
+		{testStats{run: 15, skipped: 2}, 5, true},
+		{testStats{run: 19, skipped: 3}, 1, true},
+		{testStats{run: 0, skipped: 20}, 0, false},
+	} {
+		if got := skippedMore(pre, test.post, test.threshold); got != test.want {
+			t.Errorf("%+v with threshold %d: got %v, want %v", test.post, test.threshold, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package impact
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// lookupEnv finds the value of a variable in an environment list.
+func lookupEnv(env []string, name string) (string, bool) {
+	prefix := name + "="
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], prefix) {
+			return strings.TrimPrefix(env[i], prefix), true
+		}
+	}
+	return "", false
+}
+
+// setEnv sets a variable in an environment list, replacing any existing
+// value.
+func setEnv(env []string, name, value string) []string {
+	prefix := name + "="
+	result := make([]string, 0, len(env)+1)
+	for _, s := range env {
+		if !strings.HasPrefix(s, prefix) {
+			result = append(result, s)
+		}
+	}
+	return append(result, prefix+value)
+}
+
+// useToolchain points an environment at the Go toolchain rooted at goRoot,
+// so that both the go command we run and anything it runs in turn use that
+// toolchain.
+func useToolchain(env []string, goRoot string) []string {
+	env = setEnv(env, "GOROOT", goRoot)
+	binDir := filepath.Join(goRoot, "bin")
+	if path, ok := lookupEnv(env, "PATH"); ok && path != "" {
+		return setEnv(env, "PATH", binDir+string(os.PathListSeparator)+path)
+	}
+	return setEnv(env, "PATH", binDir)
+}
+
+// toolchainRoot asks a go binary where its toolchain is rooted. This finds
+// the toolchain behind wrappers like those golang.org/dl installs, as well
+// as for binaries in a toolchain's bin directory.
+func toolchainRoot(goBinary string) (string, error) {
+	out, err := exec.Command(goBinary, "env", "GOROOT").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// goCommand builds a go command to run in the given environment, resolving
+// the go binary against the environment's PATH rather than our own, so
+// that a toolchain selected with useToolchain is honoured.
+func goCommand(env []string, args ...string) *exec.Cmd {
+	bin := "go"
+	if path, ok := lookupEnv(env, "PATH"); ok {
+		for _, dir := range filepath.SplitList(path) {
+			candidate := filepath.Join(dir, "go")
+			if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				bin = candidate
+				break
+			}
+		}
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.Env = env
+	return cmd
+}